@@ -0,0 +1,652 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"github.com/drewkett/incrbtrfs/sendstream"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const checksumExtension string = ".sha256"
+
+// writeChecksumFile writes digest next to file in the format used by
+// sha256sum, so an archive that isn't split can also be checked with
+// sha256sum -c
+func writeChecksumFile(file string, digest string) (err error) {
+	data := fmt.Sprintf("%s  %s\n", digest, path.Base(file))
+	checksumFile := file + checksumExtension
+	err = ioutil.WriteFile(checksumFile+tmpExtension, []byte(data), 0600)
+	if err != nil {
+		return
+	}
+	err = os.Rename(checksumFile+tmpExtension, checksumFile)
+	return
+}
+
+// readChecksumFile returns the digest stored next to file. The error
+// satisfies os.IsNotExist if there is no checksum file
+func readChecksumFile(file string) (digest string, err error) {
+	data, err := ioutil.ReadFile(file + checksumExtension)
+	if err != nil {
+		return
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		err = fmt.Errorf("Empty checksum file for '%s'", file)
+		return
+	}
+	digest = fields[0]
+	return
+}
+
+// WriteArchive writes a btrfs send stream of snapshot to a file in the
+// archive directory along with its checksum. The stream is incremental on
+// parent unless parent is empty. The file is written under a temporary name
+// and only renamed once it is complete
+func WriteArchive(snapshot Snapshot, parent Timestamp, config ArchiveConfig) (entry ArchiveEntry, err error) {
+	archiveDir := config.Directory
+	err = prepareArchiveDirectory(config)
+	if err != nil {
+		return
+	}
+	err = removeTempFiles(archiveDir, snapshot.timestamp)
+	if err != nil {
+		return
+	}
+
+	var btrfsCmd *exec.Cmd
+	var parentPath string
+	if parent == "" {
+		btrfsCmd = exec.Command(btrfsBin, "send", snapshot.Path())
+	} else {
+		parentPath = Snapshot{snapshot.snapshotsLoc, parent}.Path()
+		btrfsCmd = exec.Command(btrfsBin, "send", "-p", parentPath, snapshot.Path())
+	}
+
+	// The estimate is of the uncompressed stream, so the check errs on
+	// the side of caution
+	size, errEstimate := estimateSendSize(snapshot.Path(), parentPath)
+	if errEstimate != nil {
+		if verbosity > 1 {
+			log.Printf("Unable to estimate size of send stream: %s\n", errEstimate.Error())
+		}
+		size = 0
+	}
+	err = checkFreeSpace(archiveDir, size, config.MinFree)
+	if err != nil {
+		return
+	}
+
+	format := ArchiveFormat{Codec: config.Codec, Encrypted: config.KeyFile != ""}
+	archiveFile := path.Join(archiveDir, string(snapshot.timestamp)+format.Extension())
+	var f io.WriteCloser
+	var split *splitWriter
+	if config.SplitSize > 0 {
+		split = newSplitWriter(archiveFile, config.SplitSize)
+		f = split
+	} else {
+		f, err = os.Create(archiveFile + tmpExtension)
+		if err != nil {
+			return
+		}
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			removeTempFiles(archiveDir, snapshot.timestamp)
+			removeArchiveFiles(archiveFile)
+		}
+	}()
+
+	h := sha256.New()
+	out, flush, err := encodeArchive(io.MultiWriter(f, h), format, config.KeyFile)
+	if err != nil {
+		return
+	}
+	btrfsCmd.Stdout = out
+	var progress *Progress
+	if progressEnabled() {
+		progress = NewProgress("Archiving " + string(snapshot.timestamp))
+		if errEstimate == nil {
+			progress.SetTotal(size)
+		}
+		btrfsCmd.Stdout = progress.Writer(btrfsCmd.Stdout)
+	}
+
+	if verbosity > 1 {
+		printCommand(btrfsCmd)
+		btrfsCmd.Stderr = os.Stderr
+	}
+	err = btrfsCmd.Run()
+	if progress != nil {
+		progress.Finish()
+	}
+	if err != nil {
+		return
+	}
+	err = flush()
+	if err != nil {
+		return
+	}
+	err = f.Close()
+	if err != nil {
+		return
+	}
+	if split != nil {
+		err = split.Commit()
+	} else {
+		err = os.Rename(archiveFile+tmpExtension, archiveFile)
+	}
+	if err != nil {
+		return
+	}
+	// A split archive gets a single checksum of its joined parts. sha256sum
+	// -c can't check it as the file it names doesn't exist
+	err = writeChecksumFile(archiveFile, hex.EncodeToString(h.Sum(nil)))
+	if err != nil {
+		return
+	}
+	entry = ArchiveEntry{
+		Timestamp: snapshot.timestamp,
+		Parent:    parent,
+		File:      path.Base(archiveFile)}
+	if split != nil {
+		entry.Parts = split.Parts
+	}
+	return
+}
+
+// archiveParent picks the parent for an incremental archive of timestamp.
+// It is the newest archive whose snapshot still exists locally. A full
+// archive is made instead once the chain reaches fullEvery archives
+func archiveParent(manifest ArchiveManifest, localTimestamps []Timestamp, timestamp Timestamp, fullEvery int) (parent Timestamp) {
+	var archived []Timestamp
+	for _, archivedTimestamp := range manifest.Timestamps() {
+		if archivedTimestamp != timestamp {
+			archived = append(archived, archivedTimestamp)
+		}
+	}
+	parent = calcParent(localTimestamps, archived)
+	if parent == "" {
+		return
+	}
+	chain, err := manifest.Chain(parent)
+	if err != nil || (fullEvery > 0 && len(chain) >= fullEvery) {
+		parent = ""
+	}
+	return
+}
+
+const archiveParentLink string = "archive_parent"
+
+// ArchiveParent returns the snapshot the next incremental archive will be
+// based on. CleanUp keeps it even when it is outside of the limits, as long
+// as incremental archiving is enabled
+func (snapshotsLoc SnapshotsLoc) ArchiveParent() (timestamp Timestamp, err error) {
+	target, err := os.Readlink(path.Join(snapshotsLoc.Directory, archiveParentLink))
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+	timestamp = Timestamp(path.Base(target))
+	return
+}
+
+// SetArchiveParent records timestamp as the parent of the next incremental
+// archive. An empty timestamp removes the record
+func (snapshotsLoc SnapshotsLoc) SetArchiveParent(timestamp Timestamp) (err error) {
+	link := path.Join(snapshotsLoc.Directory, archiveParentLink)
+	if timestamp == "" {
+		err = os.Remove(link)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	os.Remove(link + ".tmp")
+	err = os.Symlink(path.Join("timestamp", string(timestamp)), link+".tmp")
+	if err != nil {
+		return
+	}
+	err = os.Rename(link+".tmp", link)
+	return
+}
+
+// CleanUpArchives deletes the archives in archiveDir that are outside of
+// limits. Archives that a kept archive depends on are never deleted
+func CleanUpArchives(archiveDir string, limits Limits, nowTimestamp Timestamp) (err error) {
+	now, err := parseTimestamp(nowTimestamp)
+	if err != nil {
+		return
+	}
+	manifest, err := ReadManifest(archiveDir)
+	if err != nil {
+		return
+	}
+	timestamps := manifest.Timestamps()
+	keep := []Timestamp{nowTimestamp}
+	for _, interval := range Intervals {
+		for _, timestamp := range interval.Select(limits, now, timestamps) {
+			keep = append(keep, timestamp)
+		}
+	}
+	required := manifest.Required(keep)
+	// Going from newest to oldest removes incremental archives before the
+	// archives they are based on
+	sort.Sort(sort.Reverse(Timestamps(timestamps)))
+	for _, timestamp := range timestamps {
+		if required[timestamp] {
+			continue
+		}
+		if verbosity > 1 {
+			log.Printf("Removing archive %s\n", string(timestamp))
+		}
+		err = RemoveArchive(archiveDir, &manifest, timestamp)
+		if err != nil {
+			return
+		}
+	}
+	err = manifest.Write(archiveDir)
+	return
+}
+
+// archiveDue reports whether a new archive should be written at now. With
+// an interval only one archive is written per interval
+func archiveDue(manifest ArchiveManifest, interval Interval, now time.Time) bool {
+	if interval == "" {
+		return true
+	}
+	for _, timestamp := range manifest.Timestamps() {
+		t, err := parseTimestamp(timestamp)
+		if err != nil {
+			continue
+		}
+		if interval.CalcIndex(now, t) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Archive writes an archive of snapshot to the archive directory of the
+// subvolume and records it in the manifest
+func (subvolume Subvolume) Archive(snapshot Snapshot, localTimestamps []Timestamp) (err error) {
+	config := subvolume.ArchiveConfig
+	archiveDir := config.Directory
+	manifest, err := ReadManifest(archiveDir)
+	if err != nil {
+		return
+	}
+	now, err := parseTimestamp(snapshot.timestamp)
+	if err != nil {
+		return
+	}
+	if !archiveDue(manifest, config.Interval, now) {
+		if verbosity > 1 {
+			log.Printf("Skipping archive. Already archived this %s interval\n", string(config.Interval))
+		}
+		return
+	}
+	var parent Timestamp
+	if config.Incremental {
+		parent = archiveParent(manifest, localTimestamps, snapshot.timestamp, config.FullEvery)
+	}
+	if verbosity > 1 {
+		if parent == "" {
+			log.Println("Writing full archive")
+		} else {
+			log.Printf("Writing archive incremental on %s\n", string(parent))
+		}
+	}
+	entry, err := WriteArchive(snapshot, parent, config)
+	if err != nil {
+		return
+	}
+	manifest.Add(entry)
+	err = manifest.Write(archiveDir)
+	if err != nil {
+		return
+	}
+	if config.Incremental {
+		err = subvolume.SnapshotsLoc.SetArchiveParent(snapshot.timestamp)
+	} else {
+		err = subvolume.SnapshotsLoc.SetArchiveParent("")
+	}
+	if err != nil {
+		return
+	}
+	if config.Limits != nil {
+		err = CleanUpArchives(archiveDir, *config.Limits, snapshot.timestamp)
+	}
+	return
+}
+
+// VerifyArchive checks that an archive file decodes to a complete btrfs send
+// stream and that it matches its checksum file if there is one.
+// hasChecksum reports whether a checksum file was found
+func VerifyArchive(fileName string) (summary sendstream.Summary, hasChecksum bool, err error) {
+	fileName, _, _ = trimPartSuffix(fileName)
+	_, format, err := parseArchiveName(fileName)
+	if err != nil {
+		return
+	}
+	expectedDigest, err := readChecksumFile(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	hasChecksum = err == nil
+	f, err := openArchive(fileName)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	h := sha256.New()
+	rd, err := decodeArchive(io.TeeReader(f, h), format, *archiveKeyFlag)
+	if err != nil {
+		return
+	}
+	summary, err = sendstream.Summarize(rd)
+	if err != nil {
+		return
+	}
+	// The decoder may stop before the end of the file. The checksum covers
+	// all of it
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return
+	}
+	if hasChecksum {
+		err = verifyDigest(expectedDigest, hex.EncodeToString(h.Sum(nil)))
+	}
+	return
+}
+
+// ReceiveArchive receives an archive file into snapshotsLoc. If the archive
+// has a checksum file and doesn't match it, the received snapshot is deleted
+func (snapshotsLoc SnapshotsLoc) ReceiveArchive(fileName string) (err error) {
+	fileName, _, _ = trimPartSuffix(fileName)
+	timestamp, format, err := parseArchiveName(fileName)
+	if err != nil {
+		return
+	}
+	f, err := openArchive(fileName)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	expectedDigest, err := readChecksumFile(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	err = nil
+	h := sha256.New()
+	rd, err := decodeArchive(io.TeeReader(f, h), format, *archiveKeyFlag)
+	if err != nil {
+		return
+	}
+	runner := snapshotsLoc.ReceiveSnapshot(rd, timestamp)
+	err = <-runner.Started
+	if err != nil {
+		return
+	}
+	err = <-runner.Done
+	if err != nil {
+		return
+	}
+	if expectedDigest != "" {
+		_, err = io.Copy(h, f)
+		if err == nil {
+			err = verifyDigest(expectedDigest, hex.EncodeToString(h.Sum(nil)))
+		}
+		if err != nil {
+			snapshot := Snapshot{snapshotsLoc, timestamp}
+			if errTmp := snapshot.DeleteSnapshot(); errTmp != nil {
+				log.Println(errTmp.Error())
+			}
+		}
+	}
+	return
+}
+
+// archiveFiles returns the archive files named by args, which can be
+// archive files or directories holding them
+func archiveFiles(args []string) (files []string, err error) {
+	for _, arg := range args {
+		var fi os.FileInfo
+		fi, err = os.Stat(arg)
+		if err != nil {
+			return
+		}
+		if !fi.IsDir() {
+			archiveFile, _, _ := trimPartSuffix(arg)
+			files = append(files, archiveFile)
+			continue
+		}
+		var entries []os.FileInfo
+		entries, err = ioutil.ReadDir(arg)
+		if err != nil {
+			return
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			if _, _, errName := parseArchiveName(entry.Name()); errName != nil {
+				continue
+			}
+			// Split archives are listed once, by their first part
+			archiveFile, part, isPart := trimPartSuffix(entry.Name())
+			if !isPart || part == 0 {
+				files = append(files, path.Join(arg, archiveFile))
+			}
+		}
+	}
+	return
+}
+
+// checkArchiveChain checks that the archives file depends on are present
+// and not among badFiles
+func checkArchiveChain(file string, badFiles map[string]bool) (err error) {
+	timestamp, _, err := parseArchiveName(file)
+	if err != nil {
+		return
+	}
+	archiveDir := path.Dir(file)
+	manifest, err := ReadManifest(archiveDir)
+	if err != nil {
+		return
+	}
+	if _, ok := manifest.Find(timestamp); !ok {
+		return
+	}
+	chain, err := manifest.Chain(timestamp)
+	if err != nil {
+		return
+	}
+	for _, entry := range chain[:len(chain)-1] {
+		parentFile := path.Join(archiveDir, entry.File)
+		if badFiles[parentFile] {
+			err = fmt.Errorf("Depends on damaged archive %s", entry.File)
+			return
+		}
+		if !archiveExists(parentFile) {
+			err = fmt.Errorf("Depends on missing archive %s", entry.File)
+			return
+		}
+	}
+	return
+}
+
+func runArchiveVerify() {
+	if flag.NArg() < 3 {
+		log.Println("Archive file or directory required")
+		os.Exit(1)
+	}
+	files, err := archiveFiles(flag.Args()[2:])
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	if len(files) == 0 {
+		log.Println("No archive files found")
+		os.Exit(1)
+	}
+	failed := 0
+	badFiles := make(map[string]bool)
+	var okFiles []string
+	for _, file := range files {
+		summary, hasChecksum, err := VerifyArchive(file)
+		if err != nil {
+			log.Printf("%s: FAILED: %s\n", file, err.Error())
+			badFiles[file] = true
+			failed++
+			continue
+		}
+		okFiles = append(okFiles, file)
+		if verbosity > 0 {
+			checksum := "checksum OK"
+			if !hasChecksum {
+				checksum = "no checksum file"
+			}
+			log.Printf("%s: OK (stream v%d, %d commands, %s, %s)\n", file, summary.Version, summary.Commands, formatSize(summary.Bytes), checksum)
+		}
+	}
+	// An incremental archive is only restorable if every archive it depends
+	// on is
+	for _, file := range okFiles {
+		err = checkArchiveChain(file, badFiles)
+		if err != nil {
+			log.Printf("%s: FAILED: %s\n", file, err.Error())
+			failed++
+		}
+	}
+	if verbosity > 0 {
+		log.Printf("%d of %d archives restorable\n", len(files)-failed, len(files))
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// archiveTarget returns the newest archive at or before target. An empty
+// target selects the newest archive
+func archiveTarget(manifest ArchiveManifest, target string) (timestamp Timestamp, err error) {
+	timestamp, err = timestampAtOrBefore(manifest.Timestamps(), target)
+	if err == nil && timestamp == "" {
+		err = fmt.Errorf("No archive found at or before '%s'", target)
+	}
+	return
+}
+
+// RestoreArchive receives the archive of timestamp into snapshotsLoc along
+// with every archive it depends on. Snapshots of the chain that already
+// exist in snapshotsLoc are not received again
+func (snapshotsLoc SnapshotsLoc) RestoreArchive(archiveDir string, manifest ArchiveManifest, timestamp Timestamp) (err error) {
+	chain, err := manifest.Chain(timestamp)
+	if err != nil {
+		return
+	}
+	for _, entry := range chain {
+		snapshot := Snapshot{snapshotsLoc, entry.Timestamp}
+		if _, errTmp := os.Stat(snapshot.Path()); errTmp == nil {
+			if verbosity > 1 {
+				log.Printf("%s already exists\n", snapshot.Path())
+			}
+			continue
+		}
+		if verbosity > 0 {
+			log.Printf("Receiving %s\n", entry.File)
+		}
+		err = snapshotsLoc.ReceiveArchive(path.Join(archiveDir, entry.File))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func runArchiveRestore() {
+	if flag.NArg() < 3 || flag.NArg() > 4 {
+		log.Println("Archive directory required")
+		os.Exit(1)
+	}
+	if *destinationFlag == "" {
+		log.Println("Must specify destination for archive restore")
+		os.Exit(1)
+	}
+	archiveDir := flag.Arg(2)
+	clonePath := flag.Arg(3)
+	if clonePath != "" {
+		if _, err := os.Stat(clonePath); err == nil {
+			log.Printf("'%s' already exists\n", clonePath)
+			os.Exit(1)
+		}
+	}
+	manifest, err := ReadManifest(archiveDir)
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	timestamp, err := archiveTarget(manifest, *timestampFlag)
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	if verbosity > 0 {
+		log.Printf("Restoring %s\n", string(timestamp))
+	}
+	snapshotsLoc := SnapshotsLoc{Directory: *destinationFlag}
+	lock, err := NewDirLock(snapshotsLoc.Directory)
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	defer lock.Unlock()
+	err = snapshotsLoc.RestoreArchive(archiveDir, manifest, timestamp)
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	if clonePath == "" {
+		return
+	}
+	btrfsCmd := exec.Command(btrfsBin, "subvolume", "snapshot", Snapshot{snapshotsLoc, timestamp}.Path(), clonePath)
+	if verbosity > 1 {
+		printCommand(btrfsCmd)
+		btrfsCmd.Stdout = os.Stderr
+		btrfsCmd.Stderr = os.Stderr
+	}
+	err = btrfsCmd.Run()
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	if verbosity > 0 {
+		log.Printf("Created writable clone '%s'\n", clonePath)
+	}
+}
+
+func runArchive() {
+	switch flag.Arg(1) {
+	case "verify":
+		runArchiveVerify()
+	case "restore":
+		runArchiveRestore()
+	default:
+		log.Printf("Unknown archive command '%s'\n", flag.Arg(1))
+		os.Exit(1)
+	}
+}
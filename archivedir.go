@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const tmpExtension string = ".tmp"
+
+// readMountPoints returns the mount points listed in a file in the format
+// of /etc/fstab or /proc/mounts
+func readMountPoints(file string) (mountPoints []string, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		// Spaces in mount points are escaped as \040
+		mountPoint := strings.Replace(fields[1], "\\040", " ", -1)
+		if mountPoint == "none" || mountPoint == "swap" {
+			continue
+		}
+		mountPoints = append(mountPoints, path.Clean(mountPoint))
+	}
+	err = scanner.Err()
+	return
+}
+
+// checkMounted returns an error if dir is on a filesystem listed in
+// /etc/fstab that isn't currently mounted. Writing there would silently
+// fill up the filesystem the mount point is on instead
+func checkMounted(dir string) (err error) {
+	expected, err := readMountPoints("/etc/fstab")
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return
+	}
+	mounted, err := readMountPoints("/proc/mounts")
+	if err != nil {
+		return
+	}
+	mountPoint := ""
+	for _, candidate := range expected {
+		if candidate != "/" && isSubdir(candidate, dir) && len(candidate) > len(mountPoint) {
+			mountPoint = candidate
+		}
+	}
+	if mountPoint == "" {
+		return
+	}
+	for _, m := range mounted {
+		if m == mountPoint {
+			return
+		}
+	}
+	err = fmt.Errorf("'%s' is not mounted", mountPoint)
+	return
+}
+
+// freeSpace returns the number of bytes available to unprivileged users on
+// the filesystem holding dir
+func freeSpace(dir string) (free int64, err error) {
+	var stat syscall.Statfs_t
+	err = syscall.Statfs(dir, &stat)
+	if err != nil {
+		return
+	}
+	free = int64(stat.Bavail) * int64(stat.Bsize)
+	return
+}
+
+// prepareArchiveDirectory makes sure that the archive directory is ready to
+// be written to. A configured directory must already exist, since creating
+// it could mean writing below a mount point whose filesystem is missing
+func prepareArchiveDirectory(config ArchiveConfig) (err error) {
+	if config.CreateDirectory {
+		return os.MkdirAll(config.Directory, dirMode)
+	}
+	fi, err := os.Stat(config.Directory)
+	if os.IsNotExist(err) {
+		err = fmt.Errorf("Archive directory '%s' does not exist. Is it mounted?", config.Directory)
+		return
+	} else if err != nil {
+		return
+	}
+	if !fi.IsDir() {
+		err = fmt.Errorf("Archive directory '%s' is not a directory", config.Directory)
+		return
+	}
+	dir, err := filepath.EvalSymlinks(config.Directory)
+	if err != nil {
+		return
+	}
+	return checkMounted(dir)
+}
+
+// checkFreeSpace returns an error if writing size bytes to dir would leave
+// less than minFree bytes available
+func checkFreeSpace(dir string, size int64, minFree int64) (err error) {
+	free, err := freeSpace(dir)
+	if err != nil {
+		return
+	}
+	if free-size < minFree {
+		err = fmt.Errorf("Not enough space in '%s'. %s needed, %s available", dir, formatSize(size+minFree), formatSize(free))
+	}
+	return
+}
+
+// removeTempFiles deletes archive files left behind by interrupted writes
+func removeTempFiles(archiveDir string, timestamp Timestamp) (err error) {
+	matches, err := filepath.Glob(path.Join(archiveDir, string(timestamp)+".snap*"+tmpExtension))
+	if err != nil {
+		return
+	}
+	for _, match := range matches {
+		err = os.Remove(match)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"github.com/golang/snappy"
+	"io"
+	"path"
+	"strings"
+)
+
+const CodecGzip string = "gzip"
+
+const encryptedExtension string = ".enc"
+
+var codecExtensions = map[string]string{
+	CodecNone:   "",
+	CodecSnappy: ".snpy",
+	CodecGzip:   ".gz"}
+
+// ArchiveFormat describes how the send stream in an archive file is encoded
+type ArchiveFormat struct {
+	Codec     string
+	Encrypted bool
+}
+
+func (format ArchiveFormat) Extension() string {
+	extension := ".snap" + codecExtensions[format.Codec]
+	if format.Encrypted {
+		extension += encryptedExtension
+	}
+	return extension
+}
+
+// parseArchiveName returns the timestamp and format of an archive file or
+// part of a split archive
+func parseArchiveName(fileName string) (timestamp Timestamp, format ArchiveFormat, err error) {
+	baseName, _, _ := trimPartSuffix(path.Base(fileName))
+	if strings.HasSuffix(baseName, encryptedExtension) {
+		format.Encrypted = true
+		baseName = strings.TrimSuffix(baseName, encryptedExtension)
+	}
+	for codec, extension := range codecExtensions {
+		if strings.HasSuffix(baseName, ".snap"+extension) {
+			format.Codec = codec
+			timestamp = Timestamp(strings.TrimSuffix(baseName, ".snap"+extension))
+			return
+		}
+	}
+	err = fmt.Errorf("Unrecognized file type for %s", path.Base(fileName))
+	return
+}
+
+func validCodec(codec string) bool {
+	_, ok := codecExtensions[codec]
+	return ok
+}
+
+// encodeArchive returns a writer which encodes a send stream in format and
+// writes it to wr. The returned close function flushes the encoders and
+// must be called once the stream is complete
+func encodeArchive(wr io.Writer, format ArchiveFormat, keyFile string) (out io.Writer, close func() error, err error) {
+	var closers []func() error
+	out = wr
+	if format.Encrypted {
+		var key []byte
+		key, err = readKeyFile(keyFile)
+		if err != nil {
+			return
+		}
+		var ew *encryptWriter
+		ew, err = newEncryptWriter(out, key)
+		if err != nil {
+			return
+		}
+		out = ew
+		closers = append(closers, ew.Close)
+	}
+	switch format.Codec {
+	case CodecSnappy:
+		sw := snappy.NewBufferedWriter(out)
+		out = sw
+		closers = append(closers, sw.Close)
+	case CodecGzip:
+		gw := gzip.NewWriter(out)
+		out = gw
+		closers = append(closers, gw.Close)
+	default:
+		bw := bufio.NewWriter(out)
+		out = bw
+		closers = append(closers, bw.Flush)
+	}
+	close = func() (err error) {
+		for i := len(closers) - 1; i >= 0; i-- {
+			err = closers[i]()
+			if err != nil {
+				return
+			}
+		}
+		return
+	}
+	return
+}
+
+// decodeArchive returns a reader of the send stream stored in rd. keyFile is
+// only needed for encrypted archives
+func decodeArchive(rd io.Reader, format ArchiveFormat, keyFile string) (out io.Reader, err error) {
+	out = rd
+	if format.Encrypted {
+		if keyFile == "" {
+			err = fmt.Errorf("Archive is encrypted. A key file is required")
+			return
+		}
+		var key []byte
+		key, err = readKeyFile(keyFile)
+		if err != nil {
+			return
+		}
+		out, err = newDecryptReader(out, key)
+		if err != nil {
+			return
+		}
+	}
+	switch format.Codec {
+	case CodecSnappy:
+		out = snappy.NewReader(out)
+	case CodecGzip:
+		out, err = gzip.NewReader(out)
+	}
+	return
+}
@@ -13,6 +13,25 @@ type OptionalLimits struct {
 	Monthly *int
 }
 
+// RemoteConfig is a remote as given in a config file
+type RemoteConfig struct {
+	Host       string
+	Port       string
+	User       string
+	Identity   string
+	SSHOptions []string `toml:"ssh_options"`
+	Exec       string
+	Transport  string
+	Cert       string
+	Key        string
+	CA         string
+	Resume     bool
+	BWLimit    string `toml:"bwlimit"`
+	Windows    []string
+	Directory  string
+	Limits     OptionalLimits
+}
+
 type Config struct {
 	Defaults struct {
 		Limits OptionalLimits
@@ -21,17 +40,33 @@ type Config struct {
 		}
 	}
 	Snapshot []struct {
-		Directory   string
-		Destination string
-		Limits      OptionalLimits
-		Remote      []struct {
-			Host      string
-			Port      string
-			User      string
-			Exec      string
-			Directory string
-			Limits    OptionalLimits
-		}
+		Directory          string
+		Destination        string
+		Limits             OptionalLimits
+		Pin                bool
+		Archive            bool
+		ArchiveInterval    string         `toml:"archive_interval"`
+		ArchiveDirectory   string         `toml:"archive_directory"`
+		ArchiveCodec       string         `toml:"archive_codec"`
+		ArchiveKeyFile     string         `toml:"archive_key_file"`
+		ArchiveIncremental bool           `toml:"archive_incremental"`
+		ArchiveFullEvery   *int           `toml:"archive_full_every"`
+		ArchiveLimits      OptionalLimits `toml:"archive_limits"`
+		ArchiveSplitSize   string         `toml:"archive_split_size"`
+		ArchiveMinFree     string         `toml:"archive_min_free"`
+		Remote             []RemoteConfig
+	}
+	Pull []struct {
+		Host       string
+		Port       string
+		User       string
+		Identity   string
+		SSHOptions []string `toml:"ssh_options"`
+		Exec       string
+		BWLimit    string `toml:"bwlimit"`
+		Source     string
+		Directory  string
+		Limits     OptionalLimits
 	}
 }
 
@@ -56,27 +91,181 @@ func parseConfig(config Config) (subvolumes []Subvolume) {
 		subvolume.SnapshotsLoc = SnapshotsLoc{
 			Directory: destination,
 			Limits:    localDefaults.Merge(snapshot.Limits)}
-		for _, remote := range snapshot.Remote {
-			var remoteSnapshotsLoc RemoteSnapshotsLoc
-			remoteSnapshotsLoc.User = remote.User
-			remoteSnapshotsLoc.Host = remote.Host
-			remoteSnapshotsLoc.Port = remote.Port
-			if remoteSnapshotsLoc.Port == "" {
-				remoteSnapshotsLoc.Port = "22"
-			}
-			remoteSnapshotsLoc.Exec = remote.Exec
-			if remoteSnapshotsLoc.Exec == "" {
-				remoteSnapshotsLoc.Exec = "incrbtrfs"
+		subvolume.Pinned = snapshot.Pin
+		archiveConfig := ArchiveConfig{
+			Enabled:     snapshot.Archive,
+			Interval:    Interval(snapshot.ArchiveInterval),
+			Directory:   snapshot.ArchiveDirectory,
+			Codec:       snapshot.ArchiveCodec,
+			KeyFile:     snapshot.ArchiveKeyFile,
+			Incremental: snapshot.ArchiveIncremental,
+			FullEvery:   defaultArchiveFullEvery}
+		if archiveConfig.Interval != "" && !validInterval(archiveConfig.Interval) {
+			log.Fatalln("Invalid archive_interval '" + snapshot.ArchiveInterval + "' for snapshot '" + subvolume.Directory + "'")
+		}
+		if archiveConfig.Directory == "" {
+			archiveConfig.Directory = path.Join(destination, "archive")
+			archiveConfig.CreateDirectory = true
+		} else if !path.IsAbs(archiveConfig.Directory) {
+			log.Fatalln("archive_directory must be an absolute path for snapshot '" + subvolume.Directory + "'")
+		}
+		if archiveConfig.Codec == "" {
+			archiveConfig.Codec = CodecSnappy
+		} else if !validCodec(archiveConfig.Codec) {
+			log.Fatalln("Unknown archive_codec '" + archiveConfig.Codec + "' for snapshot '" + subvolume.Directory + "'")
+		}
+		if snapshot.ArchiveFullEvery != nil {
+			archiveConfig.FullEvery = *snapshot.ArchiveFullEvery
+		}
+		if snapshot.ArchiveLimits.IsSet() {
+			archiveLimits := Limits{}.Merge(snapshot.ArchiveLimits)
+			archiveConfig.Limits = &archiveLimits
+		}
+		if snapshot.ArchiveSplitSize != "" {
+			splitSize, err := parseSize(snapshot.ArchiveSplitSize)
+			if err != nil || splitSize <= 0 {
+				log.Fatalln("Invalid archive_split_size for snapshot '" + subvolume.Directory + "'")
 			}
-			if remote.Directory == "" {
-				log.Fatalln("No remote directory specified for snapshot '" + subvolume.Directory + "'")
+			archiveConfig.SplitSize = splitSize
+		}
+		if snapshot.ArchiveMinFree != "" {
+			minFree, err := parseSize(snapshot.ArchiveMinFree)
+			if err != nil {
+				log.Fatalln("Invalid archive_min_free for snapshot '" + subvolume.Directory + "'")
 			}
-			remoteSnapshotsLoc.SnapshotsLoc = SnapshotsLoc{
-				Directory: remote.Directory,
-				Limits:    remoteDefaults.Merge(snapshot.Limits, remote.Limits)}
-			subvolume.Remotes = append(subvolume.Remotes, remoteSnapshotsLoc)
+			archiveConfig.MinFree = minFree
+		}
+		subvolume.ArchiveConfig = archiveConfig
+		applyFlagOverrides(&subvolume)
+		for _, remote := range snapshot.Remote {
+			limits := remoteDefaults.Merge(snapshot.Limits)
+			subvolume.Remotes = append(subvolume.Remotes, parseRemote(remote, limits, "snapshot '"+subvolume.Directory+"'"))
 		}
 		subvolumes = append(subvolumes, subvolume)
 	}
 	return subvolumes
 }
+
+// applyFlagOverrides applies the archive related command line flags, which
+// take precedence over the config file
+func applyFlagOverrides(subvolume *Subvolume) {
+	if *archiveFlag {
+		subvolume.ArchiveConfig.Enabled = true
+	}
+	if *pinnedFlag {
+		subvolume.Pinned = true
+	}
+	if *noCompressionFlag {
+		subvolume.ArchiveConfig.Codec = CodecNone
+	}
+	if isFlagSet("archiveIncremental") {
+		subvolume.ArchiveConfig.Incremental = *archiveIncrementalFlag
+	}
+	if isFlagSet("archiveFullEvery") {
+		subvolume.ArchiveConfig.FullEvery = *archiveFullEveryFlag
+	}
+}
+
+// parsePulls returns the sources the config file pulls snapshots from
+func parsePulls(config Config) (pulls []Pull) {
+	var localDefaults Limits
+	localDefaults = localDefaults.Merge(config.Defaults.Limits)
+	for _, pullConfig := range config.Pull {
+		if pullConfig.Host == "" || pullConfig.Source == "" {
+			log.Fatalln("host and source are required for pull")
+		}
+		if pullConfig.Directory == "" {
+			log.Fatalln("No directory specified for pull from '" + pullConfig.Host + ":" + pullConfig.Source + "'")
+		}
+		var pull Pull
+		pull.Source = RemoteSnapshotsLoc{
+			Host:       pullConfig.Host,
+			Port:       pullConfig.Port,
+			User:       pullConfig.User,
+			Identity:   pullConfig.Identity,
+			SSHOptions: pullConfig.SSHOptions,
+			Exec:       pullConfig.Exec,
+			Transport:  TransportSSH,
+			Pull:       true,
+			SnapshotsLoc: SnapshotsLoc{
+				Directory: pullConfig.Source}}
+		if pull.Source.Port == "" {
+			pull.Source.Port = "22"
+		}
+		if pull.Source.Exec == "" {
+			pull.Source.Exec = "incrbtrfs"
+		}
+		if pullConfig.BWLimit != "" {
+			bwLimit, err := parseSize(pullConfig.BWLimit)
+			if err != nil {
+				log.Fatalln("Invalid bwlimit for pull from '" + pullConfig.Host + "': " + err.Error())
+			}
+			pull.Source.BWLimit = bwLimit
+		}
+		pull.SnapshotsLoc = SnapshotsLoc{
+			Directory: pullConfig.Directory,
+			Limits:    localDefaults.Merge(pullConfig.Limits)}
+		pulls = append(pulls, pull)
+	}
+	return
+}
+
+// parseRemote returns the remote described by a remote section of a config
+// file. limits are the limits the remote's own limits are merged into and
+// name describes the section the remote belongs to in error messages
+func parseRemote(remote RemoteConfig, limits Limits, name string) (remoteSnapshotsLoc RemoteSnapshotsLoc) {
+	remoteSnapshotsLoc.User = remote.User
+	remoteSnapshotsLoc.Host = remote.Host
+	remoteSnapshotsLoc.Port = remote.Port
+	remoteSnapshotsLoc.Transport = remote.Transport
+	switch remoteSnapshotsLoc.Transport {
+	case "", TransportSSH:
+		remoteSnapshotsLoc.Transport = TransportSSH
+		if remoteSnapshotsLoc.Port == "" {
+			remoteSnapshotsLoc.Port = "22"
+		}
+	case TransportTLS:
+		if remote.Host == "" {
+			log.Fatalln("No host specified for tls remote of " + name)
+		}
+		if remote.Cert == "" || remote.Key == "" || remote.CA == "" {
+			log.Fatalln("cert, key and ca are required for tls remote of " + name)
+		}
+		if remoteSnapshotsLoc.Port == "" {
+			remoteSnapshotsLoc.Port = defaultTLSPort
+		}
+	default:
+		log.Fatalln("Unknown transport '" + remote.Transport + "' for " + name)
+	}
+	remoteSnapshotsLoc.Cert = remote.Cert
+	remoteSnapshotsLoc.Key = remote.Key
+	remoteSnapshotsLoc.CA = remote.CA
+	remoteSnapshotsLoc.Resume = remote.Resume
+	if remote.BWLimit != "" {
+		bwLimit, err := parseSize(remote.BWLimit)
+		if err != nil {
+			log.Fatalln("Invalid bwlimit for " + name + ": " + err.Error())
+		}
+		remoteSnapshotsLoc.BWLimit = bwLimit
+	}
+	for _, windowStr := range remote.Windows {
+		window, err := parseTimeWindow(windowStr)
+		if err != nil {
+			log.Fatalln("Invalid window for " + name + ": " + err.Error())
+		}
+		remoteSnapshotsLoc.Windows = append(remoteSnapshotsLoc.Windows, window)
+	}
+	remoteSnapshotsLoc.Identity = remote.Identity
+	remoteSnapshotsLoc.SSHOptions = remote.SSHOptions
+	remoteSnapshotsLoc.Exec = remote.Exec
+	if remoteSnapshotsLoc.Exec == "" {
+		remoteSnapshotsLoc.Exec = "incrbtrfs"
+	}
+	if remote.Directory == "" {
+		log.Fatalln("No remote directory specified for " + name)
+	}
+	remoteSnapshotsLoc.SnapshotsLoc = SnapshotsLoc{
+		Directory: remote.Directory,
+		Limits:    limits.Merge(remote.Limits)}
+	return
+}
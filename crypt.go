@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Encrypted archives are a header followed by chunks sealed with AES-GCM.
+// Each chunk is a 4 byte big endian length and the sealed data. The nonce
+// is a random prefix from the header and the chunk number. The last chunk
+// is sealed with different additional data, so that truncating the file at
+// a chunk boundary is detected
+const encryptMagic string = "incrbtrfs-enc1\n"
+const encryptChunkSize int = 64 * 1024
+const encryptPrefixSize int = 8
+
+// readKeyFile reads a 256 bit key stored either as 32 raw bytes or as 64
+// hex digits
+func readKeyFile(keyFile string) (key []byte, err error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return
+	}
+	if len(data) == 32 {
+		key = data
+		return
+	}
+	key, err = hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		err = fmt.Errorf("Key file '%s' must contain a 256 bit key", keyFile)
+		key = nil
+	}
+	return
+}
+
+func newGCM(key []byte) (aead cipher.AEAD, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, encryptPrefixSize+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptPrefixSize:], counter)
+	return nonce
+}
+
+func chunkAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+type encryptWriter struct {
+	wr      io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+// newEncryptWriter returns a writer which encrypts everything written to it
+// with key. Close must be called to write the final chunk
+func newEncryptWriter(wr io.Writer, key []byte) (w *encryptWriter, err error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return
+	}
+	prefix := make([]byte, encryptPrefixSize)
+	_, err = rand.Read(prefix)
+	if err != nil {
+		return
+	}
+	_, err = wr.Write(append([]byte(encryptMagic), prefix...))
+	if err != nil {
+		return
+	}
+	w = &encryptWriter{wr: wr, aead: aead, prefix: prefix, buf: make([]byte, 0, encryptChunkSize)}
+	return
+}
+
+func (w *encryptWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		if len(w.buf) == encryptChunkSize {
+			err = w.seal(false)
+			if err != nil {
+				return
+			}
+		}
+		m := encryptChunkSize - len(w.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		w.buf = append(w.buf, p[:m]...)
+		n += m
+		p = p[m:]
+	}
+	return
+}
+
+func (w *encryptWriter) seal(final bool) (err error) {
+	sealed := w.aead.Seal(nil, chunkNonce(w.prefix, w.counter), w.buf, chunkAD(final))
+	w.counter++
+	w.buf = w.buf[:0]
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(sealed)))
+	_, err = w.wr.Write(length)
+	if err != nil {
+		return
+	}
+	_, err = w.wr.Write(sealed)
+	return
+}
+
+func (w *encryptWriter) Close() error {
+	return w.seal(true)
+}
+
+type decryptReader struct {
+	rd      io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	final   bool
+}
+
+// newDecryptReader returns a reader of the data encrypted with key in rd
+func newDecryptReader(rd io.Reader, key []byte) (r *decryptReader, err error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return
+	}
+	header := make([]byte, len(encryptMagic)+encryptPrefixSize)
+	_, err = io.ReadFull(rd, header)
+	if err != nil {
+		return
+	}
+	if string(header[:len(encryptMagic)]) != encryptMagic {
+		err = fmt.Errorf("Not an encrypted archive")
+		return
+	}
+	r = &decryptReader{rd: rd, aead: aead, prefix: header[len(encryptMagic):]}
+	return
+}
+
+func (r *decryptReader) Read(p []byte) (n int, err error) {
+	for len(r.buf) == 0 {
+		if r.final {
+			return 0, io.EOF
+		}
+		err = r.open()
+		if err != nil {
+			return
+		}
+	}
+	n = copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return
+}
+
+func (r *decryptReader) open() (err error) {
+	length := make([]byte, 4)
+	_, err = io.ReadFull(r.rd, length)
+	if err == io.EOF {
+		err = fmt.Errorf("Encrypted archive is truncated")
+		return
+	} else if err != nil {
+		return
+	}
+	sealedLen := binary.BigEndian.Uint32(length)
+	if sealedLen > uint32(encryptChunkSize+r.aead.Overhead()) {
+		err = fmt.Errorf("Invalid chunk in encrypted archive")
+		return
+	}
+	sealed := make([]byte, sealedLen)
+	_, err = io.ReadFull(r.rd, sealed)
+	if err != nil {
+		return
+	}
+	nonce := chunkNonce(r.prefix, r.counter)
+	r.counter++
+	r.buf, err = r.aead.Open(nil, nonce, sealed, chunkAD(false))
+	if err == nil {
+		return
+	}
+	r.buf, err = r.aead.Open(nil, nonce, sealed, chunkAD(true))
+	if err != nil {
+		err = fmt.Errorf("Failed to decrypt archive. Wrong key or corrupted data")
+		return
+	}
+	r.final = true
+	// The final chunk has to end the archive. Anything after it, such as
+	// another archive appended to this one, wasn't written with it
+	_, err = io.ReadFull(r.rd, make([]byte, 1))
+	if err == io.EOF {
+		err = nil
+		return
+	} else if err == nil {
+		err = fmt.Errorf("Encrypted archive has data after its final chunk")
+	}
+	r.buf = nil
+	return
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+var testKey = bytes.Repeat([]byte{0x42}, 32)
+
+// encrypt encrypts data with key, writing it in pieces of at most
+// writeSize bytes
+func encrypt(t *testing.T, key []byte, data []byte, writeSize int) []byte {
+	var out bytes.Buffer
+	w, err := newEncryptWriter(&out, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p := data; len(p) > 0; {
+		n := writeSize
+		if n > len(p) {
+			n = len(p)
+		}
+		_, err = w.Write(p[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func decrypt(key []byte, encrypted []byte) ([]byte, error) {
+	r, err := newDecryptReader(bytes.NewReader(encrypted), key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// splitChunks splits encrypted data into its header and its chunks,
+// including their lengths
+func splitChunks(t *testing.T, encrypted []byte) (header []byte, chunks [][]byte) {
+	headerSize := len(encryptMagic) + encryptPrefixSize
+	header, rest := encrypted[:headerSize], encrypted[headerSize:]
+	for len(rest) > 0 {
+		n := 4 + int(binary.BigEndian.Uint32(rest))
+		if n > len(rest) {
+			t.Fatalf("Chunk of %d bytes with only %d left", n, len(rest))
+		}
+		chunks = append(chunks, rest[:n])
+		rest = rest[n:]
+	}
+	return
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	data := make([]byte, 3*encryptChunkSize+17)
+	rand.New(rand.NewSource(1)).Read(data)
+	sizes := []int{0, 1, encryptChunkSize - 1, encryptChunkSize, encryptChunkSize + 1, 2 * encryptChunkSize, len(data)}
+	for _, size := range sizes {
+		for _, writeSize := range []int{1000, encryptChunkSize, 3 * encryptChunkSize} {
+			encrypted := encrypt(t, testKey, data[:size], writeSize)
+			_, chunks := splitChunks(t, encrypted)
+			// The final chunk is never empty unless there is no data
+			want := (size + encryptChunkSize - 1) / encryptChunkSize
+			if want == 0 {
+				want = 1
+			}
+			if len(chunks) != want {
+				t.Errorf("%d bytes written as %d chunks, want %d", size, len(chunks), want)
+			}
+			if size >= 16 && bytes.Contains(encrypted, data[:16]) {
+				t.Errorf("%d bytes stored in plain text", size)
+			}
+			decrypted, err := decrypt(testKey, encrypted)
+			if err != nil {
+				t.Errorf("%d bytes written %d at a time: %s", size, writeSize, err)
+			} else if !bytes.Equal(decrypted, data[:size]) {
+				t.Errorf("%d bytes written %d at a time decrypted to %d different bytes", size, writeSize, len(decrypted))
+			}
+		}
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	data := make([]byte, 2*encryptChunkSize+100)
+	rand.New(rand.NewSource(2)).Read(data)
+	encrypted := encrypt(t, testKey, data, len(data))
+	header, chunks := splitChunks(t, encrypted)
+	if len(chunks) != 3 {
+		t.Fatalf("Got %d chunks, want 3", len(chunks))
+	}
+	other := encrypt(t, testKey, data, len(data))
+	_, otherChunks := splitChunks(t, other)
+	otherKey := bytes.Repeat([]byte{0x43}, 32)
+	flipped := append([]byte(nil), encrypted...)
+	flipped[len(header)+100] ^= 1
+	tests := []struct {
+		name      string
+		key       []byte
+		encrypted []byte
+	}{
+		{"wrong key", otherKey, encrypted},
+		{"flipped bit", testKey, flipped},
+		{"not encrypted", testKey, data},
+		{"header only", testKey, header},
+		{"truncated header", testKey, header[:len(header)-1]},
+		{"truncated final chunk", testKey, encrypted[:len(encrypted)-1]},
+		{"truncated final chunk length", testKey, concat(header, chunks[0], chunks[1], chunks[2][:2])},
+		{"missing final chunk", testKey, concat(header, chunks[0], chunks[1])},
+		{"missing middle chunk", testKey, concat(header, chunks[0], chunks[2])},
+		{"swapped chunks", testKey, concat(header, chunks[1], chunks[0], chunks[2])},
+		{"repeated chunk", testKey, concat(header, chunks[0], chunks[0], chunks[1], chunks[2])},
+		{"chunk of another archive", testKey, concat(header, otherChunks[0], chunks[1], chunks[2])},
+		{"trailing data", testKey, concat(encrypted, []byte{0})},
+		{"concatenated archives", testKey, concat(encrypted, other)},
+		{"chunk after the final chunk", testKey, concat(encrypted, chunks[2])},
+	}
+	for _, test := range tests {
+		decrypted, err := decrypt(test.key, test.encrypted)
+		if err == nil {
+			t.Errorf("%s: decrypted %d bytes without an error", test.name, len(decrypted))
+		}
+	}
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
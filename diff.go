@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/drewkett/incrbtrfs/sendstream"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	ChangeAdded    string = "added"
+	ChangeRemoved  string = "removed"
+	ChangeModified string = "modified"
+	ChangeRenamed  string = "renamed"
+)
+
+// FileChange describes how a path differs between two snapshots. Written is
+// the amount of file data the send stream rewrites, which can be more than
+// the change in size
+type FileChange struct {
+	Path    string
+	OldPath string `json:",omitempty"`
+	Change  string
+	Dir     bool
+	OldSize int64
+	NewSize int64
+	Written int64
+}
+
+type diffEntry struct {
+	created  bool
+	modified bool
+	written  int64
+}
+
+// streamDiff follows the commands of a send stream to work out which paths
+// they change. Paths in the stream refer to the tree as it is while the
+// stream is being applied, so renames are recorded to map them back to the
+// paths in the parent snapshot
+type streamDiff struct {
+	entries map[string]*diffEntry
+	renames [][2]string
+	removed []string
+}
+
+func newStreamDiff() *streamDiff {
+	return &streamDiff{entries: make(map[string]*diffEntry)}
+}
+
+// originalPath returns the path in the parent snapshot of the file that is
+// currently at p
+func (d *streamDiff) originalPath(p string) string {
+	for i := len(d.renames) - 1; i >= 0; i-- {
+		from, to := d.renames[i][0], d.renames[i][1]
+		if p == to {
+			p = from
+		} else if strings.HasPrefix(p, to+"/") {
+			p = from + p[len(to):]
+		}
+	}
+	return p
+}
+
+func (d *streamDiff) entry(p string) *diffEntry {
+	e, ok := d.entries[p]
+	if !ok {
+		e = &diffEntry{}
+		d.entries[p] = e
+	}
+	return e
+}
+
+func (d *streamDiff) handle(cmd sendstream.Command) error {
+	p := cmd.Path()
+	switch cmd.Type {
+	case sendstream.CmdMkfile, sendstream.CmdMkdir, sendstream.CmdMknod, sendstream.CmdMkfifo, sendstream.CmdMksock, sendstream.CmdSymlink, sendstream.CmdLink:
+		d.entries[p] = &diffEntry{created: true}
+	case sendstream.CmdRename:
+		to := cmd.String(sendstream.AttrPathTo)
+		d.entry(p)
+		moved := make(map[string]*diffEntry)
+		for k, e := range d.entries {
+			if k == p || strings.HasPrefix(k, p+"/") {
+				moved[to+k[len(p):]] = e
+				delete(d.entries, k)
+			}
+		}
+		for k, e := range moved {
+			d.entries[k] = e
+		}
+		d.renames = append(d.renames, [2]string{p, to})
+	case sendstream.CmdUnlink, sendstream.CmdRmdir:
+		e, ok := d.entries[p]
+		delete(d.entries, p)
+		if !ok || !e.created {
+			d.removed = append(d.removed, d.originalPath(p))
+		}
+	case sendstream.CmdWrite, sendstream.CmdEncodedWrite:
+		e := d.entry(p)
+		e.modified = true
+		e.written += int64(len(cmd.Attrs[sendstream.AttrData]))
+	case sendstream.CmdUpdateExtent:
+		e := d.entry(p)
+		e.modified = true
+		size, _ := cmd.Uint64(sendstream.AttrSize)
+		e.written += int64(size)
+	case sendstream.CmdClone:
+		e := d.entry(p)
+		e.modified = true
+		size, _ := cmd.Uint64(sendstream.AttrCloneLen)
+		e.written += int64(size)
+	case sendstream.CmdTruncate, sendstream.CmdFallocate, sendstream.CmdChmod, sendstream.CmdChown, sendstream.CmdSetXattr, sendstream.CmdRemoveXattr, sendstream.CmdFileattr:
+		d.entry(p).modified = true
+	}
+	return nil
+}
+
+// changes returns the changes found in the stream sorted by path. Sizes are
+// read from the two snapshots
+func (d *streamDiff) changes(from Snapshot, to Snapshot) (changes []FileChange) {
+	removed := make(map[string]bool)
+	for _, p := range d.removed {
+		removed[p] = true
+	}
+	for p, e := range d.entries {
+		change := FileChange{Path: p, Written: e.written}
+		switch {
+		case e.created && removed[p]:
+			// A file replaced by a new one with the same name
+			change.Change = ChangeModified
+			change.OldPath = p
+			delete(removed, p)
+		case e.created:
+			change.Change = ChangeAdded
+		default:
+			orig := d.originalPath(p)
+			if orig != p {
+				change.Change = ChangeRenamed
+				change.OldPath = orig
+			} else if e.modified {
+				change.Change = ChangeModified
+				change.OldPath = p
+			} else {
+				continue
+			}
+		}
+		changes = append(changes, change)
+	}
+	for p := range removed {
+		changes = append(changes, FileChange{Path: p, OldPath: p, Change: ChangeRemoved})
+	}
+	for i := range changes {
+		change := &changes[i]
+		if change.Change != ChangeRemoved {
+			if fi, err := os.Lstat(path.Join(to.Path(), change.Path)); err == nil {
+				change.Dir = fi.IsDir()
+				change.NewSize = fi.Size()
+			}
+		}
+		if change.OldPath != "" {
+			if fi, err := os.Lstat(path.Join(from.Path(), change.OldPath)); err == nil {
+				change.Dir = fi.IsDir()
+				change.OldSize = fi.Size()
+			}
+		}
+		if change.Change == ChangeRemoved {
+			change.OldPath = ""
+		}
+		if change.Dir {
+			change.OldSize = 0
+			change.NewSize = 0
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return
+}
+
+// Diff lists the files that differ between the snapshot from and the
+// snapshot to, using the metadata only stream that btrfs send produces for
+// the change from one to the other
+func Diff(from Snapshot, to Snapshot) (changes []FileChange, err error) {
+	cmd := exec.Command(btrfsBin, "send", "--no-data", "-p", from.Path(), to.Path())
+	if verbosity > 1 {
+		printCommand(cmd)
+		cmd.Stderr = os.Stderr
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return
+	}
+	err = cmd.Start()
+	if err != nil {
+		return
+	}
+	d := newStreamDiff()
+	_, err = sendstream.ReadAll(out, d.handle)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return
+	}
+	err = cmd.Wait()
+	if err != nil {
+		return
+	}
+	changes = d.changes(from, to)
+	return
+}
+
+// formatSizeDelta formats a change in size with its sign
+func formatSizeDelta(delta int64) string {
+	if delta < 0 {
+		return "-" + formatSize(-delta)
+	}
+	return "+" + formatSize(delta)
+}
+
+func printFileChange(change FileChange) {
+	name := change.Path
+	if change.Dir {
+		name += "/"
+	}
+	switch change.Change {
+	case ChangeAdded:
+		fmt.Printf("+ %s", name)
+	case ChangeRemoved:
+		fmt.Printf("- %s", name)
+	case ChangeModified:
+		fmt.Printf("M %s", name)
+	case ChangeRenamed:
+		fmt.Printf("R %s -> %s", change.OldPath, name)
+	}
+	if !change.Dir && change.NewSize != change.OldSize {
+		fmt.Printf("  %s", formatSizeDelta(change.NewSize-change.OldSize))
+	}
+	if change.Written > 0 {
+		fmt.Printf("  (%s written)", formatSize(change.Written))
+	}
+	fmt.Println()
+}
+
+func runDiff() {
+	if flag.NArg() < 4 || flag.NArg() > 5 {
+		log.Println("Config file and two timestamps required")
+		os.Exit(1)
+	}
+	config, err := parseFile(flag.Arg(1))
+	if err != nil {
+		log.Println("Erroring parsing file")
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	subvolumeDir := ""
+	if flag.NArg() == 5 {
+		subvolumeDir = flag.Arg(2)
+	}
+	subvolume, err := findSubvolume(parseConfig(config), subvolumeDir)
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	lock, err := NewDirLock(subvolume.SnapshotsLoc.Directory)
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	defer lock.Unlock()
+	timestamps, err := subvolume.SnapshotsLoc.ReadTimestampsDir()
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	var snapshots []Snapshot
+	for _, target := range flag.Args()[flag.NArg()-2:] {
+		var timestamp Timestamp
+		timestamp, err = timestampAtOrBefore(timestamps, target)
+		if err == nil && timestamp == "" {
+			err = fmt.Errorf("No snapshot found at or before '%s'", target)
+		}
+		if err != nil {
+			log.Println(err.Error())
+			os.Exit(1)
+		}
+		snapshots = append(snapshots, Snapshot{subvolume.SnapshotsLoc, timestamp})
+	}
+	if verbosity > 0 {
+		log.Printf("Changes from %s to %s\n", string(snapshots[0].timestamp), string(snapshots[1].timestamp))
+	}
+	changes, err := Diff(snapshots[0], snapshots[1])
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	counts := make(map[string]int)
+	var delta int64
+	for _, change := range changes {
+		counts[change.Change]++
+		delta += change.NewSize - change.OldSize
+		if *jsonFlag {
+			out, err := json.Marshal(change)
+			if err != nil {
+				log.Println(err.Error())
+				os.Exit(1)
+			}
+			fmt.Println(string(out))
+		} else {
+			printFileChange(change)
+		}
+	}
+	if verbosity > 0 {
+		log.Printf("%d added, %d removed, %d modified, %d renamed, size %s\n", counts[ChangeAdded], counts[ChangeRemoved], counts[ChangeModified], counts[ChangeRenamed], formatSizeDelta(delta))
+	}
+}
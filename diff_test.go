@@ -0,0 +1,109 @@
+package main
+
+import (
+	"github.com/drewkett/incrbtrfs/sendstream"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// testCommand returns a command on p with the given string attributes
+func testCommand(typ sendstream.CommandType, p string, attrs map[sendstream.Attribute]string) sendstream.Command {
+	cmd := sendstream.Command{Type: typ, Attrs: map[sendstream.Attribute][]byte{sendstream.AttrPath: []byte(p)}}
+	for attr, value := range attrs {
+		cmd.Attrs[attr] = []byte(value)
+	}
+	return cmd
+}
+
+func renameCommand(from string, to string) sendstream.Command {
+	return testCommand(sendstream.CmdRename, from, map[sendstream.Attribute]string{sendstream.AttrPathTo: to})
+}
+
+func writeCommand(p string, data string) sendstream.Command {
+	return testCommand(sendstream.CmdWrite, p, map[sendstream.Attribute]string{sendstream.AttrData: data})
+}
+
+func TestStreamDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		commands []sendstream.Command
+		removed  []string
+		changes  []FileChange
+	}{
+		{
+			"unlink after renaming the file",
+			[]sendstream.Command{
+				renameCommand("a", "o257-5-0"),
+				testCommand(sendstream.CmdUnlink, "o257-5-0", nil),
+			},
+			[]string{"a"},
+			[]FileChange{{Path: "a", Change: ChangeRemoved}},
+		},
+		{
+			"unlink after renaming its directory",
+			[]sendstream.Command{
+				renameCommand("dir", "dir2"),
+				renameCommand("dir2", "dir3"),
+				testCommand(sendstream.CmdUnlink, "dir3/file", nil),
+			},
+			[]string{"dir/file"},
+			[]FileChange{
+				{Path: "dir/file", Change: ChangeRemoved},
+				{Path: "dir3", OldPath: "dir", Change: ChangeRenamed},
+			},
+		},
+		{
+			"rename and write",
+			[]sendstream.Command{
+				writeCommand("old", "abc"),
+				renameCommand("old", "new"),
+				writeCommand("new", "de"),
+			},
+			nil,
+			[]FileChange{{Path: "new", OldPath: "old", Change: ChangeRenamed, Written: 5}},
+		},
+		{
+			"created and removed",
+			[]sendstream.Command{
+				testCommand(sendstream.CmdMkfile, "o258-5-0", nil),
+				renameCommand("o258-5-0", "tmp"),
+				writeCommand("tmp", "abc"),
+				testCommand(sendstream.CmdUnlink, "tmp", nil),
+				testCommand(sendstream.CmdMkfile, "o259-5-0", nil),
+				renameCommand("o259-5-0", "kept"),
+			},
+			nil,
+			[]FileChange{{Path: "kept", Change: ChangeAdded}},
+		},
+		{
+			"replaced",
+			[]sendstream.Command{
+				testCommand(sendstream.CmdUnlink, "file", nil),
+				testCommand(sendstream.CmdMkfile, "file", nil),
+			},
+			[]string{"file"},
+			[]FileChange{{Path: "file", OldPath: "file", Change: ChangeModified}},
+		},
+	}
+	dir := t.TempDir()
+	from := Snapshot{SnapshotsLoc{Directory: dir}, "from"}
+	to := Snapshot{SnapshotsLoc{Directory: dir}, "to"}
+	for _, test := range tests {
+		d := newStreamDiff()
+		for _, cmd := range test.commands {
+			err := d.handle(cmd)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		sort.Strings(d.removed)
+		if !reflect.DeepEqual(d.removed, test.removed) {
+			t.Errorf("%s: removed %q, want %q", test.name, d.removed, test.removed)
+		}
+		changes := d.changes(from, to)
+		if !reflect.DeepEqual(changes, test.changes) {
+			t.Errorf("%s: changes %+v, want %+v", test.name, changes, test.changes)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/golang/snappy"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+)
+
+// sendCommand returns the btrfs send command for the snapshot, incremental on
+// parent if it is set
+func (snapshot Snapshot) sendCommand(parent Timestamp) *exec.Cmd {
+	if parent == "" {
+		return exec.Command(btrfsBin, "send", snapshot.Path())
+	}
+	return exec.Command(btrfsBin, "send", "-p", Snapshot{snapshot.snapshotsLoc, parent}.Path(), snapshot.Path())
+}
+
+// SendStream runs btrfs send for the snapshot and writes the stream encoded
+// with codec to dw. It returns the digest of the uncompressed stream, which
+// is also passed along at the end of the stream
+func (snapshot Snapshot) SendStream(parent Timestamp, codec string, dw dataWriter) (digest string, err error) {
+	var w io.Writer = dw
+	var sw *snappy.Writer
+	switch codec {
+	case "", CodecNone:
+	case CodecSnappy:
+		sw = snappy.NewBufferedWriter(dw)
+		w = sw
+	default:
+		err = fmt.Errorf("Unsupported codec '%s'", codec)
+		return
+	}
+	h := sha256.New()
+	sendCmd := snapshot.sendCommand(parent)
+	if verbosity > 1 {
+		printCommand(sendCmd)
+		sendCmd.Stderr = os.Stderr
+	}
+	sendCmd.Stdout = io.MultiWriter(w, h)
+	err = sendCmd.Run()
+	if err != nil {
+		return
+	}
+	if sw != nil {
+		err = sw.Close()
+		if err != nil {
+			return
+		}
+	}
+	err = dw.CloseDigest(hex.EncodeToString(h.Sum(nil)))
+	if err != nil {
+		return
+	}
+	digest = hex.EncodeToString(h.Sum(nil))
+	return
+}
+
+// fetchParent returns the newest snapshot older than timestamp that exists
+// both in snapshotsLoc and in remoteTimestamps
+func fetchParent(snapshotsLoc SnapshotsLoc, timestamp Timestamp, remoteTimestamps []Timestamp) (parent Timestamp, err error) {
+	localTimestamps, err := snapshotsLoc.ReadTimestampsDir()
+	if err != nil {
+		return
+	}
+	var older []Timestamp
+	for _, localTimestamp := range localTimestamps {
+		if localTimestamp < timestamp {
+			older = append(older, localTimestamp)
+		}
+	}
+	parent = calcParent(remoteTimestamps, older)
+	if verbosity > 0 && parent != "" {
+		log.Printf("Parent = %s\n", string(parent))
+	}
+	return
+}
+
+// Fetch copies the snapshot with the given timestamp from the remote into
+// snapshotsLoc. The copy is incremental on a snapshot both sides have when
+// possible
+func (remote RemoteSnapshotsLoc) Fetch(snapshotsLoc SnapshotsLoc, timestamp Timestamp) (err error) {
+	if remote.Host != "" {
+		return remote.fetchRPC(snapshotsLoc, timestamp)
+	}
+	remoteTimestamps, err := remote.SnapshotsLoc.ReadTimestampsDir()
+	if err != nil {
+		return
+	}
+	parent, err := fetchParent(snapshotsLoc, timestamp, remoteTimestamps)
+	if err != nil {
+		return
+	}
+	snapshot := Snapshot{remote.SnapshotsLoc, timestamp}
+	sendCmd := snapshot.sendCommand(parent)
+	if verbosity > 1 {
+		printCommand(sendCmd)
+		sendCmd.Stderr = os.Stderr
+	}
+	out, err := sendCmd.StdoutPipe()
+	if err != nil {
+		return
+	}
+	err = sendCmd.Start()
+	if err != nil {
+		return
+	}
+	runner := snapshotsLoc.ReceiveSnapshot(out, timestamp)
+	err = <-runner.Started
+	if err == nil {
+		err = <-runner.Done
+	}
+	if err != nil {
+		log.Println("Error running btrfs receive")
+		sendCmd.Process.Kill()
+		sendCmd.Wait()
+		return
+	}
+	err = sendCmd.Wait()
+	if err != nil {
+		log.Println("Error running btrfs send")
+		Snapshot{snapshotsLoc, timestamp}.DeleteSnapshot()
+	}
+	return
+}
+
+// fetchRPC asks the incrbtrfs on the remote host to send the snapshot and
+// receives it into snapshotsLoc
+func (remote RemoteSnapshotsLoc) fetchRPC(snapshotsLoc SnapshotsLoc, timestamp Timestamp) (err error) {
+	conn, err := remote.dialRPC()
+	if err == errLegacyProtocol {
+		err = fmt.Errorf("The incrbtrfs version on '%s' is too old to send snapshots", remote.Host)
+	}
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if !conn.Has(CapSend) {
+		err = fmt.Errorf("The incrbtrfs version on '%s' is too old to send snapshots", remote.Host)
+		return
+	}
+	response, err := conn.Call(Request{Op: OpCheck, Destination: remote.SnapshotsLoc.Directory}, nil)
+	if err != nil {
+		return
+	}
+	var remoteTimestamps []Timestamp
+	for _, remoteTimestamp := range response.Timestamps {
+		remoteTimestamps = append(remoteTimestamps, Timestamp(remoteTimestamp))
+	}
+	parent, err := fetchParent(snapshotsLoc, timestamp, remoteTimestamps)
+	if err != nil {
+		return
+	}
+	codec := CodecNone
+	if !*noCompressionFlag && conn.Has(CapSnappy) {
+		codec = CodecSnappy
+	}
+	err = conn.writeJSON(frameRequest, Request{
+		Op:          OpSend,
+		Destination: remote.SnapshotsLoc.Directory,
+		Timestamp:   string(timestamp),
+		Parent:      string(parent),
+		Codec:       codec})
+	if err != nil {
+		return
+	}
+	data := conn.DataReader()
+	// A request the remote rejects ends the stream right away, followed by
+	// the response with the reason
+	buffered := bufio.NewReader(data)
+	if _, errPeek := buffered.Peek(1); errPeek == io.EOF {
+		err = conn.readJSON(frameResponse, &response)
+		if err == nil && response.Error != "" {
+			err = errors.New(response.Error)
+		} else if err == nil {
+			err = fmt.Errorf("Remote sent an empty stream for %s", string(timestamp))
+		}
+		return
+	}
+	var in io.Reader = buffered
+	if remote.BWLimit > 0 {
+		in = io.TeeReader(in, newRateLimitedWriter(ioutil.Discard, remote.BWLimit))
+	}
+	if codec == CodecSnappy {
+		in = snappy.NewReader(in)
+	}
+	if progressEnabled() {
+		progress := NewProgress("Fetching " + string(timestamp))
+		defer progress.Finish()
+		in = io.TeeReader(in, progress.Writer(ioutil.Discard))
+	}
+	h := sha256.New()
+	in = io.TeeReader(in, h)
+	runner := snapshotsLoc.ReceiveSnapshot(in, timestamp)
+	err = <-runner.Started
+	if err == nil {
+		err = <-runner.Done
+	}
+	if err != nil {
+		log.Println("Error running btrfs receive")
+		if !data.done {
+			// The remote is still sending the stream, which is never read
+			// now. Waiting for it in the deferred Close would never end
+			conn.Kill()
+			return
+		}
+		// The stream was cut short by the remote, which explains why in
+		// the response
+		var errResponse Response
+		if conn.readJSON(frameResponse, &errResponse) == nil && errResponse.Error != "" {
+			err = errors.New(errResponse.Error)
+		}
+		return
+	}
+	// btrfs receive may stop reading before the end of the stream, but all
+	// of it has to be part of the digest
+	_, err = io.Copy(ioutil.Discard, in)
+	if err == nil {
+		err = conn.readJSON(frameResponse, &response)
+	}
+	if err == nil && response.Error != "" {
+		err = errors.New(response.Error)
+	}
+	if err == nil {
+		err = verifyDigest(data.Digest(), hex.EncodeToString(h.Sum(nil)))
+	}
+	if err != nil {
+		if errTmp := (Snapshot{snapshotsLoc, timestamp}).DeleteSnapshot(); errTmp != nil {
+			log.Println(errTmp.Error())
+		}
+		return
+	}
+	if verbosity > 1 {
+		log.Printf("Verified checksum %s\n", data.Digest())
+	}
+	return
+}
+
+func runFetch() {
+	if flag.NArg() < 2 || flag.NArg() > 3 {
+		log.Println("Config file required")
+		os.Exit(1)
+	}
+	config, err := parseFile(flag.Arg(1))
+	if err != nil {
+		log.Println("Erroring parsing file")
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	subvolume, err := findSubvolume(parseConfig(config), flag.Arg(2))
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	remote, err := findRemote(subvolume, *remoteFlag)
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	lock, err := NewDirLock(subvolume.SnapshotsLoc.Directory)
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	defer lock.Unlock()
+
+	var timestamps []Timestamp
+	if remote.Host == "" {
+		timestamps, err = remote.SnapshotsLoc.ReadTimestampsDir()
+	} else {
+		timestamps, err = remote.GetTimestamps()
+	}
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	timestamp, err := timestampAtOrBefore(timestamps, *timestampFlag)
+	if err == nil && timestamp == "" {
+		err = fmt.Errorf("No snapshot found on '%s' at or before '%s'", remote.String(), *timestampFlag)
+	}
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	if _, err = os.Stat(Snapshot{subvolume.SnapshotsLoc, timestamp}.Path()); err == nil {
+		log.Printf("%s already exists in '%s'\n", string(timestamp), subvolume.SnapshotsLoc.Directory)
+		return
+	}
+	if verbosity > 0 {
+		log.Printf("Fetching %s from '%s'\n", string(timestamp), remote.String())
+	}
+	err = remote.Fetch(subvolume.SnapshotsLoc, timestamp)
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/signal"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Forwards returns the remotes that snapshots received into snapshotsLoc are
+// forwarded to. snapshotsLoc may be below the directory of the destination,
+// in which case the same relative directory is used on each remote. Their
+// limits default to the limits of snapshotsLoc
+func (destination ServerDestination) Forwards(snapshotsLoc SnapshotsLoc) (remotes []RemoteSnapshotsLoc) {
+	rel := strings.TrimPrefix(strings.TrimPrefix(snapshotsLoc.Directory, destination.Directory), "/")
+	for _, forward := range destination.Forward {
+		remote := parseRemote(forward, snapshotsLoc.Limits, "forward of destination '"+destination.Directory+"'")
+		remote.SnapshotsLoc.Directory = path.Join(remote.SnapshotsLoc.Directory, rel)
+		remotes = append(remotes, remote)
+	}
+	return
+}
+
+// calcParentByUUID returns the newest snapshot before timestamp in
+// localInfos that the remote holds a copy of. Copies are recognized by their
+// received UUID rather than their timestamp, which is what btrfs receive
+// uses to find the parent of an incremental stream. present is set if the
+// remote already holds a copy of the snapshot itself
+func calcParentByUUID(localInfos []SubvolumeInfo, remoteInfos []SubvolumeInfo, timestamp Timestamp) (parent Timestamp, present bool) {
+	received := make(map[string]bool)
+	for _, info := range remoteInfos {
+		if info.ReceivedUUID != "" {
+			received[info.ReceivedUUID] = true
+		}
+	}
+	sort.Slice(localInfos, func(i, j int) bool { return localInfos[i].Timestamp > localInfos[j].Timestamp })
+	for _, info := range localInfos {
+		if !received[info.SourceUUID()] {
+			continue
+		}
+		if Timestamp(info.Timestamp) == timestamp {
+			present = true
+		} else if Timestamp(info.Timestamp) < timestamp && parent == "" {
+			parent = Timestamp(info.Timestamp)
+		}
+	}
+	return
+}
+
+// ForwardSnapshot sends a received snapshot on to the remote, incrementally
+// on the newest older snapshot the remote has a copy of. The caller is
+// expected to hold the lock on the directory of the snapshot
+func (remote RemoteSnapshotsLoc) ForwardSnapshot(snapshot Snapshot) (err error) {
+	localInfos, err := snapshot.snapshotsLoc.ReadSubvolumeInfos()
+	if err != nil {
+		return
+	}
+	remoteInfos, err := remote.subvolumeInfos()
+	if err != nil {
+		return
+	}
+	parent, present := calcParentByUUID(localInfos, remoteInfos, snapshot.timestamp)
+	if present {
+		if verbosity > 0 {
+			log.Printf("%s already on '%s'\n", string(snapshot.timestamp), remote.String())
+		}
+		return
+	}
+	if verbosity > 0 && parent != "" {
+		log.Printf("Parent = %s\n", string(parent))
+	}
+	err = remote.SendSnapshot(snapshot, parent)
+	return
+}
+
+// ForwardReceived forwards each of the received snapshots to the remotes of
+// the destination it was received into. Failures are logged and reported
+// through isErr so that one unreachable remote doesn't stop the others
+func (config ServerConfig) ForwardReceived(snapshots []Snapshot) (isErr bool) {
+	for _, snapshot := range snapshots {
+		destination, ok := config.FindDestination(snapshot.snapshotsLoc.Directory)
+		if !ok || len(destination.Forward) == 0 {
+			continue
+		}
+		lock, err := NewDirLock(snapshot.snapshotsLoc.Directory)
+		if err == nil {
+			err = forwardSnapshot(snapshot, destination.Forwards(snapshot.snapshotsLoc))
+			lock.Unlock()
+		}
+		if err != nil {
+			log.Printf("Error forwarding %s: %s\n", string(snapshot.timestamp), err.Error())
+			isErr = true
+		}
+	}
+	return
+}
+
+// ignoreClientGone keeps a server that was started for a single client over
+// ssh forwarding when that client is interrupted. Its stderr goes back over
+// the ssh session, and writing to it once the session is gone would kill the
+// process. Only call it in processes that exit after serving the client
+func ignoreClientGone() {
+	signal.Ignore(syscall.SIGPIPE)
+}
+
+// forwardSnapshot sends the snapshot to each of the remotes. The caller is
+// expected to hold the lock on the directory of the snapshot
+func forwardSnapshot(snapshot Snapshot, remotes []RemoteSnapshotsLoc) (err error) {
+	failed := 0
+	now := time.Now()
+	for _, remote := range remotes {
+		if !remote.InWindow(now) {
+			if verbosity > 0 {
+				log.Printf("Skipping remote '%s'. Outside of send windows\n", remote.String())
+			}
+			continue
+		}
+		if verbosity > 0 {
+			log.Printf("Forwarding %s to '%s'\n", string(snapshot.timestamp), remote.String())
+		}
+		errTmp := remote.ForwardSnapshot(snapshot)
+		if errTmp != nil {
+			log.Printf("Remote '%s': %s\n", remote.String(), errTmp.Error())
+			failed++
+		}
+	}
+	if failed > 0 {
+		err = fmt.Errorf("%d of %d remotes failed", failed, len(remotes))
+	}
+	return
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FileVersion describes a file as it is in one snapshot
+type FileVersion struct {
+	Timestamp string
+	Exists    bool
+	Mode      os.FileMode
+	Size      int64
+	ModTime   time.Time
+	Hash      string `json:",omitempty"`
+	Target    string `json:",omitempty"`
+	Changed   bool
+}
+
+// sameContents reports whether two versions of a file have the same type,
+// size, modification time and contents
+func (v FileVersion) sameContents(other FileVersion) bool {
+	return v.Exists == other.Exists &&
+		v.Mode == other.Mode &&
+		v.Size == other.Size &&
+		v.ModTime.Equal(other.ModTime) &&
+		v.Hash == other.Hash &&
+		v.Target == other.Target
+}
+
+// findSubvolumeOf returns the configured subvolume that file is in and the
+// path of file relative to it
+func findSubvolumeOf(subvolumes []Subvolume, file string) (subvolume Subvolume, relPath string, err error) {
+	file, err = filepath.Abs(file)
+	if err != nil {
+		return
+	}
+	found := ""
+	for _, candidate := range subvolumes {
+		var dir string
+		dir, err = filepath.Abs(candidate.Directory)
+		if err != nil {
+			return
+		}
+		if isSubdir(dir, file) && len(dir) > len(found) {
+			subvolume = candidate
+			found = dir
+		}
+	}
+	if found == "" {
+		err = fmt.Errorf("'%s' is not in any subvolume of the config file", file)
+		return
+	}
+	relPath = strings.TrimPrefix(strings.TrimPrefix(file, found), "/")
+	if relPath == "" {
+		err = fmt.Errorf("'%s' is a subvolume. Use restore instead", file)
+		return
+	}
+	snapshotsDir, err := filepath.Abs(subvolume.SnapshotsLoc.Directory)
+	if err != nil {
+		return
+	}
+	if isSubdir(snapshotsDir, file) {
+		err = fmt.Errorf("'%s' is in the snapshots directory", file)
+	}
+	return
+}
+
+// fileVersion returns the version of relPath in the snapshot. The contents
+// of regular files are only hashed if hash is set
+func (s Snapshot) fileVersion(relPath string, hash bool) (version FileVersion, err error) {
+	version.Timestamp = string(s.timestamp)
+	file := path.Join(s.Path(), relPath)
+	fi, err := os.Lstat(file)
+	if os.IsNotExist(err) {
+		return version, nil
+	} else if err != nil {
+		return
+	}
+	version.Exists = true
+	version.Mode = fi.Mode()
+	version.ModTime = fi.ModTime()
+	switch {
+	case fi.Mode().IsRegular():
+		version.Size = fi.Size()
+		if hash {
+			version.Hash, err = hashFile(file)
+		}
+	case fi.Mode()&os.ModeSymlink != 0:
+		version.Target, err = os.Readlink(file)
+	}
+	return
+}
+
+// FileHistory returns the version of relPath in every snapshot, oldest
+// first. Changed is set on the versions that differ from the one in the
+// previous snapshot. Without hash, changes to the contents that keep the size
+// and modification time are not detected
+func (snapshotsLoc SnapshotsLoc) FileHistory(relPath string, hash bool) (versions []FileVersion, err error) {
+	timestamps, err := snapshotsLoc.ReadTimestampsDir()
+	if err != nil {
+		return
+	}
+	sort.Sort(Timestamps(timestamps))
+	var previous FileVersion
+	for _, timestamp := range timestamps {
+		var version FileVersion
+		version, err = Snapshot{snapshotsLoc, timestamp}.fileVersion(relPath, hash)
+		if err != nil {
+			return
+		}
+		version.Changed = !version.sameContents(previous)
+		versions = append(versions, version)
+		previous = version
+	}
+	return
+}
+
+func printFileVersion(version FileVersion) {
+	marker := " "
+	if version.Changed {
+		marker = "*"
+	}
+	if !version.Exists {
+		fmt.Printf("%s %s  missing\n", marker, version.Timestamp)
+		return
+	}
+	modTime := version.ModTime.Format("2006-01-02 15:04:05")
+	switch {
+	case version.Mode.IsRegular():
+		fmt.Printf("%s %s  %s  %10s  %.12s\n", marker, version.Timestamp, modTime, formatSize(version.Size), version.Hash)
+	case version.Mode&os.ModeSymlink != 0:
+		fmt.Printf("%s %s  %s  -> %s\n", marker, version.Timestamp, modTime, version.Target)
+	default:
+		fmt.Printf("%s %s  %s  %s\n", marker, version.Timestamp, modTime, version.Mode.String())
+	}
+}
+
+// loadFileHistory parses the config file given after the command and
+// returns the snapshots location and history of the file given after it.
+// The snapshots location is locked until the returned lock is released
+func loadFileHistory(hash bool) (snapshotsLoc SnapshotsLoc, relPath string, versions []FileVersion, lock DirLock) {
+	if flag.NArg() != 3 {
+		log.Println("Config file and file required")
+		os.Exit(1)
+	}
+	config, err := parseFile(flag.Arg(1))
+	if err != nil {
+		log.Println("Erroring parsing file")
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	subvolume, relPath, err := findSubvolumeOf(parseConfig(config), flag.Arg(2))
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	snapshotsLoc = subvolume.SnapshotsLoc
+	lock, err = NewDirLock(snapshotsLoc.Directory)
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	versions, err = snapshotsLoc.FileHistory(relPath, hash)
+	if err != nil {
+		lock.Unlock()
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	return
+}
+
+func runHistory() {
+	_, relPath, versions, lock := loadFileHistory(true)
+	lock.Unlock()
+	found := false
+	for _, version := range versions {
+		if !version.Exists && (!version.Changed || !found) {
+			continue
+		}
+		found = true
+		if *jsonFlag {
+			out, err := json.Marshal(version)
+			if err != nil {
+				log.Println(err.Error())
+				os.Exit(1)
+			}
+			fmt.Println(string(out))
+		} else {
+			printFileVersion(version)
+		}
+	}
+	if !found {
+		log.Printf("'%s' is not in any snapshot\n", relPath)
+		os.Exit(1)
+	}
+}
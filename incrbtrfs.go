@@ -3,12 +3,9 @@ package main
 import (
 	"encoding/json"
 	"flag"
-	"github.com/golang/snappy"
-	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
-	"path"
 	"strings"
 	"time"
 )
@@ -27,25 +24,41 @@ const subDir string = ".incrbtrfs"
 const timeFormat string = "20060102_150405"
 const version int = 3
 const dirMode os.FileMode = 0700 | os.ModeDir
+const defaultArchiveFullEvery int = 7
 
 var quietFlag = flag.Bool("quiet", false, "Quiet Mode")
 var verboseFlag = flag.Bool("verbose", false, "Verbose Mode")
 var debugFlag = flag.Bool("debug", false, "Debug Mode")
+var jsonFlag = flag.Bool("json", false, "Write progress to stdout as JSON lines")
 var destinationFlag = flag.String("destination", "", "Destination directory for -receive")
 var checkFlag = flag.Bool("check", false, "Activate Check Mode for -receive")
 var receiveFlag = flag.Bool("receive", false, "Receive Mode")
+var rpcFlag = flag.Bool("rpc", false, "Serve the framed protocol on stdin/stdout")
 var loadFileFlag = flag.String("loadFile", "", "Load Snapshot File")
-var timestampFlag = flag.String("timestamp", "", "Timestamp for Receive Mode")
+var timestampFlag = flag.String("timestamp", "", "Timestamp for Receive Mode or the time to restore with archive restore")
 var hourlyFlag = flag.Int("hourly", 0, "Hourly Limit")
 var dailyFlag = flag.Int("daily", 0, "Daily Limit")
 var weeklyFlag = flag.Int("weekly", 0, "Weekly Limit")
 var monthlyFlag = flag.Int("monthly", 0, "Monthly Limit")
 var pinnedFlag = flag.Bool("pin", false, "Keep snapshots indefinitely")
-var archiveFlag = flag.Bool("archive", false, "Create archive file of snapshots (implies -pin)")
+var archiveFlag = flag.Bool("archive", false, "Create archive file of snapshots")
+var archiveIncrementalFlag = flag.Bool("archiveIncremental", false, "Make each archive incremental on the previous one")
+var archiveFullEveryFlag = flag.Int("archiveFullEvery", defaultArchiveFullEvery, "Number of archives in an incremental chain before a new full archive (0 for no limit)")
+var archiveKeyFlag = flag.String("archiveKey", "", "Key file for reading encrypted archives")
 var noCompressionFlag = flag.Bool("noCompression", false, "Disable compression for btrfs send/receive and -archive")
 
 var verbosity = 1
 
+// isFlagSet reports whether the flag was given on the command line
+func isFlagSet(name string) (isSet bool) {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			isSet = true
+		}
+	})
+	return
+}
+
 func printCommand(cmd *exec.Cmd) {
 	log.Printf("Running '%s %s'\n", cmd.Path, strings.Join(cmd.Args[1:], " "))
 }
@@ -75,40 +88,12 @@ func runLoadFile() {
 	}
 	defer lock.Unlock()
 	fileName := *loadFileFlag
-	baseName := path.Base(fileName)
-	var timestampStr string
-	var compressed bool
-	if strings.HasSuffix(baseName, ".snap.snpy") {
-		timestampStr = strings.TrimSuffix(baseName, ".snap.snpy")
-		compressed = true
-	} else if strings.HasSuffix(baseName, ".snap") {
-		timestampStr = strings.TrimSuffix(baseName, ".snap")
-		compressed = false
-	} else {
-		log.Printf("Unrecognized file type for %s", baseName)
-		os.Exit(1)
-	}
-	f, err := os.Open(fileName)
-	if err != nil {
-		log.Println(err.Error())
-		os.Exit(1)
-	}
-	defer f.Close()
-
-	timestamp := Timestamp(timestampStr)
-	var runner CmdRunner
-	if compressed {
-		cf := snappy.NewReader(f)
-		runner = snapshotsLoc.ReceiveSnapshot(cf, timestamp)
-	} else {
-		runner = snapshotsLoc.ReceiveSnapshot(f, timestamp)
-	}
-	err = <-runner.Started
+	timestamp, _, err := parseArchiveName(fileName)
 	if err != nil {
 		log.Println(err.Error())
 		os.Exit(1)
 	}
-	err = <-runner.Done
+	err = snapshotsLoc.ReceiveArchive(fileName)
 	if err != nil {
 		log.Println(err.Error())
 		os.Exit(1)
@@ -127,6 +112,21 @@ type RemoteCheck struct {
 	Timestamps []string
 }
 
+// newRemoteCheck lists the timestamps available in snapshotsLoc. The caller
+// is expected to hold the lock on the directory
+func newRemoteCheck(snapshotsLoc SnapshotsLoc) (checkStr RemoteCheck, err error) {
+	timestamps, err := snapshotsLoc.ReadTimestampsDir()
+	if err != nil {
+		return
+	}
+	checkStr.Version = version
+	checkStr.Timestamps = make([]string, 0)
+	for _, timestamp := range timestamps {
+		checkStr.Timestamps = append(checkStr.Timestamps, string(timestamp))
+	}
+	return
+}
+
 func runRemoteCheck() {
 	if *destinationFlag == "" {
 		log.Println("Must specify destination in receive-check mode")
@@ -139,30 +139,11 @@ func runRemoteCheck() {
 		os.Exit(1)
 	}
 	defer lock.Unlock()
-	timestampsDir := path.Join(recvDir, "timestamp")
-	err = os.MkdirAll(timestampsDir, dirMode)
+	checkStr, err := newRemoteCheck(SnapshotsLoc{Directory: recvDir})
 	if err != nil {
 		log.Println(err.Error())
 		os.Exit(1)
 	}
-	fis, err := ioutil.ReadDir(timestampsDir)
-	if err != nil {
-		log.Println(err.Error())
-		os.Exit(1)
-	}
-	var checkStr RemoteCheck
-	checkStr.Version = version
-	checkStr.Timestamps = make([]string, 0)
-	for _, fi := range fis {
-		if fi.IsDir() {
-			timestamp := Timestamp(fi.Name())
-			_, err := parseTimestamp(timestamp)
-			if err != nil {
-				continue
-			}
-			checkStr.Timestamps = append(checkStr.Timestamps, string(timestamp))
-		}
-	}
 	data, err := json.Marshal(checkStr)
 	if err != nil {
 		log.Println(err.Error())
@@ -191,6 +172,18 @@ func runRemote() {
 		Daily:   *dailyFlag,
 		Weekly:  *weeklyFlag,
 		Monthly: *monthlyFlag}
+	pin := *pinnedFlag
+	config, err := loadServerPolicy()
+	if err != nil {
+		log.Println("Error parsing server config")
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	destination, hasPolicy := config.FindDestination(snapshotsLoc.Directory)
+	if hasPolicy {
+		snapshotsLoc.Limits = destination.Policy(snapshotsLoc.Limits)
+		pin = pin || destination.Pin
+	}
 
 	lock, err := NewDirLock(snapshotsLoc.Directory)
 	if err != nil {
@@ -204,31 +197,24 @@ func runRemote() {
 		log.Println(err.Error())
 		os.Exit(1)
 	}
-	if verbosity > 2 {
-		log.Println("runRemote: ReceiveAndCleanUp")
-	}
-	var runner CmdRunner
-	if *noCompressionFlag {
-		runner = snapshotsLoc.ReceiveAndCleanUp(os.Stdin, timestamp)
-	} else {
-		rd := snappy.NewReader(os.Stdin)
-		runner = snapshotsLoc.ReceiveAndCleanUp(rd, timestamp)
-	}
-	err = <-runner.Started
-	if verbosity > 2 {
-		log.Println("runRemote: ReceiveAndCleanUp Started")
-	}
+	err = snapshotsLoc.Receive(os.Stdin, timestamp, !*noCompressionFlag, nil)
 	if err != nil {
 		log.Println(err.Error())
 		os.Exit(1)
 	}
-	err = <-runner.Done
-	if verbosity > 2 {
-		log.Println("runRemote: ReceiveAndCleanUp Done")
+	if pin {
+		err = snapshotsLoc.PinTimestamp(timestamp)
+		if err != nil {
+			log.Println(err.Error())
+			os.Exit(1)
+		}
 	}
-	if err != nil {
-		log.Println(err.Error())
-		os.Exit(1)
+	if hasPolicy && len(destination.Forward) > 0 {
+		err = forwardSnapshot(Snapshot{snapshotsLoc, timestamp}, destination.Forwards(snapshotsLoc))
+		if err != nil {
+			log.Println(err.Error())
+			os.Exit(1)
+		}
 	}
 }
 
@@ -255,6 +241,16 @@ func runLocal() {
 			isErr = true
 		}
 	}
+	for _, pull := range parsePulls(config) {
+		if verbosity > 0 {
+			pull.Print()
+		}
+		err = pull.Run()
+		if err != nil {
+			log.Println(err)
+			isErr = true
+		}
+	}
 	if isErr {
 		os.Exit(1)
 	}
@@ -283,18 +279,47 @@ func main() {
 		verbosity = 0
 	}
 
-	if *archiveFlag {
-		*pinnedFlag = true
-	}
-
 	if *loadFileFlag != "" {
 		runLoadFile()
+	} else if *rpcFlag {
+		setRemoteLogging()
+		runRPC()
 	} else if *receiveFlag && *checkFlag {
 		setRemoteLogging()
 		runRemoteCheck()
 	} else if *receiveFlag {
 		setRemoteLogging()
 		runRemote()
+	} else if flag.Arg(0) == "restricted" {
+		setRemoteLogging()
+		runRestricted()
+	} else if flag.Arg(0) == "sender" {
+		setRemoteLogging()
+		runSender()
+	} else if flag.Arg(0) == "serve" {
+		runServe()
+	} else if flag.Arg(0) == "verify" {
+		runVerify()
+	} else if flag.Arg(0) == "archive" {
+		runArchive()
+	} else if flag.Arg(0) == "restore" {
+		runRestore()
+	} else if flag.Arg(0) == "history" || flag.Arg(0) == "find" {
+		runHistory()
+	} else if flag.Arg(0) == "restore-file" {
+		runRestoreFile()
+	} else if flag.Arg(0) == "inspect" {
+		runInspect()
+	} else if flag.Arg(0) == "diff" {
+		runDiff()
+	} else if flag.Arg(0) == "fetch" {
+		runFetch()
+	} else if flag.Arg(0) == "pin" {
+		runPin()
+	} else if flag.Arg(0) == "unpin" {
+		runUnpin()
+	} else if flag.Arg(0) == "pins" {
+		runPins()
 	} else {
 		runLocal()
 	}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/drewkett/incrbtrfs/sendstream"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+)
+
+// openStream opens a send stream for reading. fileName is an archive file,
+// a file holding a plain stream or - for standard input
+func openStream(fileName string) (rd io.ReadCloser, err error) {
+	if fileName == "-" {
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+	archiveFile, _, _ := trimPartSuffix(fileName)
+	_, format, errName := parseArchiveName(archiveFile)
+	if errName != nil {
+		return os.Open(fileName)
+	}
+	f, err := openArchive(archiveFile)
+	if err != nil {
+		return
+	}
+	decoded, err := decodeArchive(f, format, *archiveKeyFlag)
+	if err != nil {
+		f.Close()
+		return
+	}
+	rd = struct {
+		io.Reader
+		io.Closer
+	}{decoded, f}
+	return
+}
+
+func printStreamSummary(summary sendstream.Summary) {
+	fmt.Printf("Stream version %d: %d commands, %s\n", summary.Version, summary.Commands, formatSize(summary.Bytes))
+	fmt.Printf("Paths touched: %d\n", summary.Paths)
+	fmt.Printf("Write data: %s\n", formatSize(summary.WriteBytes))
+	if summary.ExtentBytes > 0 {
+		fmt.Printf("Extents without data: %s\n", formatSize(summary.ExtentBytes))
+	}
+	if summary.CloneBytes > 0 {
+		fmt.Printf("Cloned data: %s\n", formatSize(summary.CloneBytes))
+	}
+	var names []string
+	for name := range summary.Counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Println("Commands:")
+	for _, name := range names {
+		fmt.Printf("  %-14s %d\n", name, summary.Counts[name])
+	}
+}
+
+func runInspect() {
+	if flag.NArg() != 2 {
+		log.Println("Archive file or - for standard input required")
+		os.Exit(1)
+	}
+	rd, err := openStream(flag.Arg(1))
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	defer rd.Close()
+	summary, err := sendstream.Summarize(rd)
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	if *jsonFlag {
+		out, err := json.Marshal(summary)
+		if err != nil {
+			log.Println(err.Error())
+			os.Exit(1)
+		}
+		fmt.Println(string(out))
+	} else {
+		printStreamSummary(summary)
+	}
+}
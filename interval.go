@@ -13,6 +13,15 @@ const (
 
 var Intervals = [...]Interval{Hourly, Daily, Weekly, Monthly}
 
+func validInterval(interval Interval) bool {
+	for _, i := range Intervals {
+		if i == interval {
+			return true
+		}
+	}
+	return false
+}
+
 func (interval Interval) CalcIndex(now time.Time, snapshotTime time.Time) int {
 	firstMonday := time.Date(1970, 1, 5, 0, 0, 0, 0, time.UTC)
 	switch interval {
@@ -47,3 +56,26 @@ func (interval Interval) GetMaxIndex(limits Limits) int {
 	}
 	return 0
 }
+
+// Select returns the timestamps to keep for the interval, keyed by how many
+// intervals before now they are. The first timestamp in each interval is
+// kept
+func (interval Interval) Select(limits Limits, now time.Time, timestamps []Timestamp) (kept map[int]Timestamp) {
+	maxIndex := interval.GetMaxIndex(limits)
+	kept = make(map[int]Timestamp)
+	for _, timestamp := range timestamps {
+		snapshotTime, err := parseTimestamp(timestamp)
+		if err != nil {
+			continue
+		}
+		i := interval.CalcIndex(now, snapshotTime)
+		if i >= maxIndex {
+			continue
+		}
+		if _, ok := kept[i]; ok {
+			continue
+		}
+		kept[i] = timestamp
+	}
+	return
+}
@@ -30,3 +30,42 @@ func (limits Limits) Merge(newLimits ...OptionalLimits) Limits {
 	}
 	return limits
 }
+
+// Raise increases each limit to the minimum given for it, if any
+func (limits Limits) Raise(min OptionalLimits) Limits {
+	if min.Hourly != nil && limits.Hourly < *min.Hourly {
+		limits.Hourly = *min.Hourly
+	}
+	if min.Daily != nil && limits.Daily < *min.Daily {
+		limits.Daily = *min.Daily
+	}
+	if min.Weekly != nil && limits.Weekly < *min.Weekly {
+		limits.Weekly = *min.Weekly
+	}
+	if min.Monthly != nil && limits.Monthly < *min.Monthly {
+		limits.Monthly = *min.Monthly
+	}
+	return limits
+}
+
+// Clamp lowers each limit to the maximum given for it, if any
+func (limits Limits) Clamp(max OptionalLimits) Limits {
+	if max.Hourly != nil && limits.Hourly > *max.Hourly {
+		limits.Hourly = *max.Hourly
+	}
+	if max.Daily != nil && limits.Daily > *max.Daily {
+		limits.Daily = *max.Daily
+	}
+	if max.Weekly != nil && limits.Weekly > *max.Weekly {
+		limits.Weekly = *max.Weekly
+	}
+	if max.Monthly != nil && limits.Monthly > *max.Monthly {
+		limits.Monthly = *max.Monthly
+	}
+	return limits
+}
+
+// IsSet reports whether any of the limits were specified
+func (l OptionalLimits) IsSet() bool {
+	return l.Hourly != nil || l.Daily != nil || l.Weekly != nil || l.Monthly != nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+)
+
+const manifestFile string = "manifest.json"
+
+// ArchiveEntry describes one archive file. Parent is empty for a full
+// archive, otherwise the archive is an incremental send stream which can
+// only be received after the archive of Parent. Parts is the number of
+// files a split archive consists of
+type ArchiveEntry struct {
+	Timestamp Timestamp
+	Parent    Timestamp `json:",omitempty"`
+	File      string
+	Parts     int `json:",omitempty"`
+}
+
+// ArchiveManifest tracks the archives in an archive directory and how they
+// depend on each other
+type ArchiveManifest struct {
+	Archives []ArchiveEntry
+}
+
+// ReadManifest reads the manifest of archiveDir. Directories written before
+// manifests existed only hold full archives, so a missing manifest is built
+// from the archive files found
+func ReadManifest(archiveDir string) (manifest ArchiveManifest, err error) {
+	data, err := ioutil.ReadFile(path.Join(archiveDir, manifestFile))
+	if err == nil {
+		err = json.Unmarshal(data, &manifest)
+		return
+	}
+	if !os.IsNotExist(err) {
+		return
+	}
+	err = nil
+	entries, err := ioutil.ReadDir(archiveDir)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		timestamp, _, errName := parseArchiveName(entry.Name())
+		if errName != nil {
+			continue
+		}
+		archiveFile, part, isPart := trimPartSuffix(entry.Name())
+		if isPart && part != 0 {
+			continue
+		}
+		manifest.Add(ArchiveEntry{Timestamp: timestamp, File: archiveFile})
+	}
+	return
+}
+
+// Write replaces the manifest in archiveDir. The new manifest is written to
+// a temporary file first so that an interrupted write never leaves a
+// truncated manifest behind
+func (manifest ArchiveManifest) Write(archiveDir string) (err error) {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return
+	}
+	manifestPath := path.Join(archiveDir, manifestFile)
+	err = ioutil.WriteFile(manifestPath+".tmp", data, 0600)
+	if err != nil {
+		return
+	}
+	err = os.Rename(manifestPath+".tmp", manifestPath)
+	return
+}
+
+// Add records an archive, replacing any previous entry for its timestamp
+func (manifest *ArchiveManifest) Add(entry ArchiveEntry) {
+	manifest.Remove(entry.Timestamp)
+	manifest.Archives = append(manifest.Archives, entry)
+	sort.Slice(manifest.Archives, func(i, j int) bool {
+		return manifest.Archives[i].Timestamp < manifest.Archives[j].Timestamp
+	})
+}
+
+// Remove drops the entry for timestamp from the manifest
+func (manifest *ArchiveManifest) Remove(timestamp Timestamp) {
+	archives := manifest.Archives[:0]
+	for _, entry := range manifest.Archives {
+		if entry.Timestamp != timestamp {
+			archives = append(archives, entry)
+		}
+	}
+	manifest.Archives = archives
+}
+
+func (manifest ArchiveManifest) Find(timestamp Timestamp) (entry ArchiveEntry, ok bool) {
+	for _, entry = range manifest.Archives {
+		if entry.Timestamp == timestamp {
+			return entry, true
+		}
+	}
+	return ArchiveEntry{}, false
+}
+
+func (manifest ArchiveManifest) Timestamps() (timestamps []Timestamp) {
+	for _, entry := range manifest.Archives {
+		timestamps = append(timestamps, entry.Timestamp)
+	}
+	return
+}
+
+// Chain returns the archives that need to be received in order to restore
+// timestamp, starting with the full archive it is based on
+func (manifest ArchiveManifest) Chain(timestamp Timestamp) (chain []ArchiveEntry, err error) {
+	seen := make(TimestampMap)
+	for timestamp != "" {
+		if seen[timestamp] {
+			err = fmt.Errorf("Archive chain of %s contains a loop", string(timestamp))
+			return
+		}
+		seen[timestamp] = true
+		entry, ok := manifest.Find(timestamp)
+		if !ok {
+			err = fmt.Errorf("Archive %s is missing from the manifest", string(timestamp))
+			return
+		}
+		chain = append([]ArchiveEntry{entry}, chain...)
+		timestamp = entry.Parent
+	}
+	return
+}
+
+// Required returns the timestamps in keep along with every archive they
+// depend on
+func (manifest ArchiveManifest) Required(keep []Timestamp) (required TimestampMap) {
+	required = make(TimestampMap)
+	for _, timestamp := range keep {
+		for timestamp != "" && !required[timestamp] {
+			entry, ok := manifest.Find(timestamp)
+			if !ok {
+				break
+			}
+			required[timestamp] = true
+			timestamp = entry.Parent
+		}
+	}
+	return
+}
+
+// Dependents returns the archives which are incremental on timestamp
+func (manifest ArchiveManifest) Dependents(timestamp Timestamp) (dependents []Timestamp) {
+	for _, entry := range manifest.Archives {
+		if entry.Parent == timestamp {
+			dependents = append(dependents, entry.Timestamp)
+		}
+	}
+	return
+}
+
+// RemoveArchive deletes the archive of timestamp along with its checksum
+// file. It refuses to delete an archive that other archives depend on
+func RemoveArchive(archiveDir string, manifest *ArchiveManifest, timestamp Timestamp) (err error) {
+	entry, ok := manifest.Find(timestamp)
+	if !ok {
+		err = fmt.Errorf("Archive %s is missing from the manifest", string(timestamp))
+		return
+	}
+	if dependents := manifest.Dependents(timestamp); len(dependents) > 0 {
+		err = fmt.Errorf("Archive %s is required by %d other archives", string(timestamp), len(dependents))
+		return
+	}
+	archiveFile := path.Join(archiveDir, entry.File)
+	err = removeArchiveFiles(archiveFile)
+	if err != nil {
+		return
+	}
+	err = os.Remove(archiveFile + checksumExtension)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	err = nil
+	manifest.Remove(timestamp)
+	return
+}
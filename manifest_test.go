@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// testManifest builds a manifest from pairs of timestamps and parents
+func testManifest(pairs ...Timestamp) (manifest ArchiveManifest) {
+	for i := 0; i+1 < len(pairs); i += 2 {
+		manifest.Add(ArchiveEntry{Timestamp: pairs[i], Parent: pairs[i+1], File: string(pairs[i]) + ".snap"})
+	}
+	return
+}
+
+func sortedTimestamps(timestampMap TimestampMap) (timestamps []Timestamp) {
+	for timestamp := range timestampMap {
+		timestamps = append(timestamps, timestamp)
+	}
+	sort.Sort(Timestamps(timestamps))
+	return
+}
+
+// chains holds a full archive with two incrementals on it and a second full
+// archive with one incremental
+var chains = testManifest(
+	"20160101_000000", "",
+	"20160102_000000", "20160101_000000",
+	"20160103_000000", "20160102_000000",
+	"20160104_000000", "",
+	"20160105_000000", "20160104_000000",
+)
+
+func TestArchiveManifestRequired(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest ArchiveManifest
+		keep     []Timestamp
+		required []Timestamp
+	}{
+		{"nothing kept", chains, nil, nil},
+		{"full archive", chains, []Timestamp{"20160104_000000"}, []Timestamp{"20160104_000000"}},
+		{"end of chain", chains, []Timestamp{"20160103_000000"}, []Timestamp{"20160101_000000", "20160102_000000", "20160103_000000"}},
+		{"middle of chain", chains, []Timestamp{"20160102_000000"}, []Timestamp{"20160101_000000", "20160102_000000"}},
+		{"both chains", chains, []Timestamp{"20160105_000000", "20160102_000000"}, []Timestamp{"20160101_000000", "20160102_000000", "20160104_000000", "20160105_000000"}},
+		{"not archived", chains, []Timestamp{"20160106_000000"}, nil},
+		{"missing parent", testManifest(
+			"20160102_000000", "20160101_000000",
+			"20160103_000000", "20160102_000000",
+		), []Timestamp{"20160103_000000"}, []Timestamp{"20160102_000000", "20160103_000000"}},
+		{"loop", testManifest(
+			"20160101_000000", "20160102_000000",
+			"20160102_000000", "20160101_000000",
+		), []Timestamp{"20160102_000000"}, []Timestamp{"20160101_000000", "20160102_000000"}},
+	}
+	for _, test := range tests {
+		required := sortedTimestamps(test.manifest.Required(test.keep))
+		if !reflect.DeepEqual(required, test.required) {
+			t.Errorf("%s: required %v, want %v", test.name, required, test.required)
+		}
+	}
+}
+
+func TestArchiveParent(t *testing.T) {
+	all := []Timestamp{"20160101_000000", "20160102_000000", "20160103_000000", "20160104_000000", "20160105_000000", "20160106_000000"}
+	tests := []struct {
+		name      string
+		manifest  ArchiveManifest
+		local     []Timestamp
+		timestamp Timestamp
+		fullEvery int
+		parent    Timestamp
+	}{
+		{"no archives", ArchiveManifest{}, all, "20160106_000000", 7, ""},
+		{"newest archive", chains, all, "20160106_000000", 7, "20160105_000000"},
+		{"newest archive deleted locally", chains, all[:3], "20160106_000000", 7, "20160103_000000"},
+		{"no archived snapshot left locally", chains, all[5:], "20160106_000000", 7, ""},
+		{"chain shorter than full_every", chains, all[:3], "20160106_000000", 4, "20160103_000000"},
+		{"chain reaching full_every", chains, all[:3], "20160106_000000", 3, ""},
+		{"new chain after full_every", chains, all, "20160106_000000", 3, "20160105_000000"},
+		{"no limit", chains, all[:3], "20160106_000000", 0, "20160103_000000"},
+		{"archived again", chains, all, "20160105_000000", 7, "20160104_000000"},
+		{"parent missing from the manifest", testManifest(
+			"20160102_000000", "20160101_000000",
+		), all, "20160106_000000", 7, ""},
+	}
+	for _, test := range tests {
+		parent := archiveParent(test.manifest, test.local, test.timestamp, test.fullEvery)
+		if parent != test.parent {
+			t.Errorf("%s: parent %q, want %q", test.name, parent, test.parent)
+		}
+	}
+}
+
+func TestCleanUpArchives(t *testing.T) {
+	dir := t.TempDir()
+	for _, timestamp := range chains.Timestamps() {
+		for _, file := range []string{string(timestamp) + ".snap", string(timestamp) + ".snap" + checksumExtension} {
+			err := ioutil.WriteFile(path.Join(dir, file), nil, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	err := chains.Write(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the archive of the 5th is within the limits. The full archive it
+	// is based on is kept as well, while nothing depends on the first chain
+	err = CleanUpArchives(dir, Limits{Daily: 1}, "20160105_000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := ReadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Timestamp{"20160104_000000", "20160105_000000"}
+	if !reflect.DeepEqual(manifest.Timestamps(), want) {
+		t.Errorf("Kept %v, want %v", manifest.Timestamps(), want)
+	}
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, fileInfo := range fileInfos {
+		files = append(files, fileInfo.Name())
+	}
+	wantFiles := []string{
+		"20160104_000000.snap", "20160104_000000.snap" + checksumExtension,
+		"20160105_000000.snap", "20160105_000000.snap" + checksumExtension,
+		manifestFile,
+	}
+	if !reflect.DeepEqual(files, wantFiles) {
+		t.Errorf("Files %v, want %v", files, wantFiles)
+	}
+
+	// An archive others depend on can't be removed directly either
+	err = RemoveArchive(dir, &manifest, "20160104_000000")
+	if err == nil {
+		t.Errorf("Removed an archive another one depends on")
+	}
+}
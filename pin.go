@@ -0,0 +1,423 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+var expiresFlag = flag.String("expires", "", "Time or duration (such as 720h) after which a pin no longer keeps its snapshot")
+
+// pinExpirySep separates the name of a pin from its expiry in the name of
+// its symlink in the pinned directory
+const pinExpirySep string = "@"
+
+// Pin keeps a snapshot from being cleaned up until it expires. Pins are
+// symlinks in the pinned directory named after the pin, followed by
+// @<timestamp> if it expires. Pins made by the pin option are named after the
+// timestamp of their snapshot
+type Pin struct {
+	Name      string
+	Timestamp Timestamp
+	// Expires is empty for pins that never expire
+	Expires Timestamp `json:",omitempty"`
+}
+
+func validPinName(name string) (err error) {
+	if name == "" || name == "." || name == ".." || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("Invalid pin name '%s'", name)
+	}
+	if strings.ContainsAny(name, "/"+pinExpirySep) {
+		return fmt.Errorf("Pin name '%s' can't contain '/' or '%s'", name, pinExpirySep)
+	}
+	return
+}
+
+func (pin Pin) fileName() string {
+	if pin.Expires == "" {
+		return pin.Name
+	}
+	return pin.Name + pinExpirySep + string(pin.Expires)
+}
+
+// Expired reports whether the pin no longer applies at time now
+func (pin Pin) Expired(now time.Time) bool {
+	if pin.Expires == "" {
+		return false
+	}
+	t, err := parseTimestamp(pin.Expires)
+	return err != nil || !now.Before(t)
+}
+
+// parsePinFile reads a pin from the name and target of its symlink
+func parsePinFile(fileName string, target string) (pin Pin, err error) {
+	pin.Name = fileName
+	if i := strings.LastIndex(fileName, pinExpirySep); i >= 0 {
+		pin.Name = fileName[:i]
+		pin.Expires = Timestamp(fileName[i+len(pinExpirySep):])
+		_, err = parseTimestamp(pin.Expires)
+		if err != nil {
+			return
+		}
+	}
+	err = validPinName(pin.Name)
+	if err != nil {
+		return
+	}
+	// The symlink is expected to point into the timestamp directory
+	pin.Timestamp = Timestamp(path.Base(target))
+	_, err = parseTimestamp(pin.Timestamp)
+	return
+}
+
+func (snapshotsLoc SnapshotsLoc) pinDir() string {
+	return path.Join(snapshotsLoc.Directory, "pinned")
+}
+
+// ReadPins returns the pins of the location sorted by name, including
+// expired ones and those whose snapshot doesn't exist. Symlinks whose name
+// isn't a valid pin are left out
+func (snapshotsLoc SnapshotsLoc) ReadPins() (pins []Pin, err error) {
+	pins, _, err = snapshotsLoc.readPinFiles()
+	return
+}
+
+// readPinFiles reads the pinned directory. invalid maps the names of the
+// symlinks that aren't valid pins to the timestamp they point to
+func (snapshotsLoc SnapshotsLoc) readPinFiles() (pins []Pin, invalid map[string]Timestamp, err error) {
+	invalid = make(map[string]Timestamp)
+	fileInfos, err := ioutil.ReadDir(snapshotsLoc.pinDir())
+	if os.IsNotExist(err) {
+		return nil, invalid, nil
+	} else if err != nil {
+		return
+	}
+	for _, fileInfo := range fileInfos {
+		if fileInfo.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		var target string
+		target, err = os.Readlink(path.Join(snapshotsLoc.pinDir(), fileInfo.Name()))
+		if err != nil {
+			// Without its target it isn't known which snapshot to keep
+			return
+		}
+		pin, errTmp := parsePinFile(fileInfo.Name(), target)
+		if errTmp != nil {
+			invalid[fileInfo.Name()] = Timestamp(path.Base(target))
+			continue
+		}
+		pins = append(pins, pin)
+	}
+	sort.Slice(pins, func(i, j int) bool { return pins[i].Name < pins[j].Name })
+	return
+}
+
+// AddPin creates the pin, replacing any pin with the same name
+func (snapshotsLoc SnapshotsLoc) AddPin(pin Pin) (err error) {
+	err = validPinName(pin.Name)
+	if err != nil {
+		return
+	}
+	_, err = parseTimestamp(pin.Timestamp)
+	if err != nil {
+		return
+	}
+	if pin.Expires != "" {
+		_, err = parseTimestamp(pin.Expires)
+		if err != nil {
+			return
+		}
+	}
+	err = os.MkdirAll(snapshotsLoc.pinDir(), dirMode)
+	if err != nil {
+		return
+	}
+	_, err = snapshotsLoc.RemovePin(pin.Name)
+	if err != nil {
+		return
+	}
+	src := path.Join("..", "timestamp", string(pin.Timestamp))
+	dst := path.Join(snapshotsLoc.pinDir(), pin.fileName())
+	if verbosity > 1 {
+		log.Printf("Symlink '%s' => '%s'\n", dst, src)
+	}
+	err = os.Symlink(src, dst)
+	return
+}
+
+// RemovePin removes the pin with the given name. found is false if there is
+// no such pin
+func (snapshotsLoc SnapshotsLoc) RemovePin(name string) (found bool, err error) {
+	pins, err := snapshotsLoc.ReadPins()
+	if err != nil {
+		return
+	}
+	for _, pin := range pins {
+		if pin.Name != name {
+			continue
+		}
+		dst := path.Join(snapshotsLoc.pinDir(), pin.fileName())
+		if verbosity > 1 {
+			log.Printf("Removing '%s'\n", dst)
+		}
+		err = os.Remove(dst)
+		if err != nil {
+			return
+		}
+		found = true
+	}
+	return
+}
+
+func (snapshotsLoc SnapshotsLoc) PinTimestamp(timestamp Timestamp) (err error) {
+	return snapshotsLoc.AddPin(Pin{Name: string(timestamp), Timestamp: timestamp})
+}
+
+// replicatedFile lists the names of the pins in the pinned directory that
+// were replicated from the location snapshots are sent from
+const replicatedFile string = ".replicated"
+
+func (snapshotsLoc SnapshotsLoc) readReplicatedPins() (names map[string]bool, err error) {
+	names = make(map[string]bool)
+	data, err := ioutil.ReadFile(path.Join(snapshotsLoc.pinDir(), replicatedFile))
+	if os.IsNotExist(err) {
+		return names, nil
+	} else if err != nil {
+		return
+	}
+	for _, name := range strings.Split(string(data), "\n") {
+		if name != "" {
+			names[name] = true
+		}
+	}
+	return
+}
+
+func (snapshotsLoc SnapshotsLoc) writeReplicatedPins(names map[string]bool) (err error) {
+	var list []string
+	for name := range names {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	err = os.MkdirAll(snapshotsLoc.pinDir(), dirMode)
+	if err != nil {
+		return
+	}
+	return ioutil.WriteFile(path.Join(snapshotsLoc.pinDir(), replicatedFile), []byte(strings.Join(list, "\n")+"\n"), 0644)
+}
+
+// SyncPins adds and updates the pins replicated from the location snapshots
+// are sent from. Pins made here are left alone, even if a replicated pin has
+// the same name. If unpin is set pins replicated earlier that are no longer
+// in pins are removed
+func (snapshotsLoc SnapshotsLoc) SyncPins(pins []Pin, unpin bool) (err error) {
+	current, err := snapshotsLoc.ReadPins()
+	if err != nil {
+		return
+	}
+	currentMap := make(map[string]Pin)
+	for _, pin := range current {
+		currentMap[pin.Name] = pin
+	}
+	replicated, err := snapshotsLoc.readReplicatedPins()
+	if err != nil {
+		return
+	}
+	wanted := make(map[string]bool)
+	for _, pin := range pins {
+		existing, ok := currentMap[pin.Name]
+		if ok && !replicated[pin.Name] {
+			if verbosity > 1 && existing != pin {
+				log.Printf("Keeping local pin '%s'\n", pin.Name)
+			}
+			continue
+		}
+		wanted[pin.Name] = true
+		if ok && existing == pin {
+			continue
+		}
+		if verbosity > 0 {
+			log.Printf("Pinning %s as '%s'\n", string(pin.Timestamp), pin.Name)
+		}
+		err = snapshotsLoc.AddPin(pin)
+		if err != nil {
+			return
+		}
+	}
+	for name := range replicated {
+		if wanted[name] {
+			continue
+		}
+		if _, ok := currentMap[name]; !ok {
+			continue
+		}
+		if !unpin {
+			wanted[name] = true
+			continue
+		}
+		if verbosity > 0 {
+			log.Printf("Unpinning '%s'\n", name)
+		}
+		_, err = snapshotsLoc.RemovePin(name)
+		if err != nil {
+			return
+		}
+	}
+	err = snapshotsLoc.writeReplicatedPins(wanted)
+	return
+}
+
+// activePins returns the pins of the location that haven't expired, which
+// are replicated to remotes
+func (snapshotsLoc SnapshotsLoc) activePins(now time.Time) (pins []Pin, err error) {
+	all, err := snapshotsLoc.ReadPins()
+	if err != nil {
+		return
+	}
+	for _, pin := range all {
+		if !pin.Expired(now) {
+			pins = append(pins, pin)
+		}
+	}
+	return
+}
+
+// parseExpires parses the -expires flag, which is either a time accepted by
+// parseTargetTime or a duration from now
+func parseExpires(expires string, now time.Time) (timestamp Timestamp, err error) {
+	if expires == "" {
+		return
+	}
+	t, err := parseTargetTime(expires)
+	if err != nil {
+		d, errDuration := time.ParseDuration(expires)
+		if errDuration != nil {
+			return
+		}
+		err = nil
+		t = now.Add(d)
+	}
+	if !t.After(now) {
+		err = fmt.Errorf("Expiry '%s' is in the past", expires)
+		return
+	}
+	timestamp = Timestamp(t.Format(timeFormat))
+	return
+}
+
+func printPin(pin Pin, now time.Time) {
+	fmt.Printf("%-20s %s", pin.Name, string(pin.Timestamp))
+	if pin.Expires != "" {
+		if pin.Expired(now) {
+			fmt.Printf("  expired %s", string(pin.Expires))
+		} else {
+			fmt.Printf("  expires %s", string(pin.Expires))
+		}
+	}
+	fmt.Println()
+}
+
+// loadPinSubvolume reads the config file and returns the subvolume given on
+// the command line with its snapshot directory locked. nArgs is the number
+// of arguments following the optional subvolume
+func loadPinSubvolume(nArgs int, usage string) (subvolume Subvolume, lock DirLock) {
+	if flag.NArg() < 2+nArgs || flag.NArg() > 3+nArgs {
+		log.Println(usage)
+		os.Exit(1)
+	}
+	config, err := parseFile(flag.Arg(1))
+	if err != nil {
+		log.Println("Erroring parsing file")
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	subvolumeDir := ""
+	if flag.NArg() == 3+nArgs {
+		subvolumeDir = flag.Arg(2)
+	}
+	subvolume, err = findSubvolume(parseConfig(config), subvolumeDir)
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	lock, err = NewDirLock(subvolume.SnapshotsLoc.Directory)
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	return
+}
+
+// runPin pins the snapshot at or before -timestamp, or the latest one, under
+// the name given as the last argument
+func runPin() {
+	subvolume, lock := loadPinSubvolume(1, "Config file and pin name required")
+	defer lock.Unlock()
+	now := time.Now()
+	pin := Pin{Name: flag.Arg(flag.NArg() - 1)}
+	timestamps, err := subvolume.SnapshotsLoc.ReadTimestampsDir()
+	if err == nil {
+		pin.Timestamp, err = timestampAtOrBefore(timestamps, *timestampFlag)
+		if err == nil && pin.Timestamp == "" {
+			err = fmt.Errorf("No snapshot found at or before '%s'", *timestampFlag)
+		}
+	}
+	if err == nil {
+		pin.Expires, err = parseExpires(*expiresFlag, now)
+	}
+	if err == nil {
+		err = subvolume.SnapshotsLoc.AddPin(pin)
+	}
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	if verbosity > 0 {
+		printPin(pin, now)
+	}
+}
+
+func runUnpin() {
+	subvolume, lock := loadPinSubvolume(1, "Config file and pin name required")
+	defer lock.Unlock()
+	name := flag.Arg(flag.NArg() - 1)
+	found, err := subvolume.SnapshotsLoc.RemovePin(name)
+	if err == nil && !found {
+		err = fmt.Errorf("No pin named '%s'", name)
+	}
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+}
+
+func runPins() {
+	subvolume, lock := loadPinSubvolume(0, "Config file required")
+	defer lock.Unlock()
+	pins, err := subvolume.SnapshotsLoc.ReadPins()
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	now := time.Now()
+	for _, pin := range pins {
+		if *jsonFlag {
+			out, err := json.Marshal(pin)
+			if err != nil {
+				log.Println(err.Error())
+				os.Exit(1)
+			}
+			fmt.Println(string(out))
+		} else {
+			printPin(pin, now)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/drewkett/incrbtrfs/sendstream"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const progressTTYInterval time.Duration = time.Second
+const progressLogInterval time.Duration = 30 * time.Second
+
+var jsonMutex sync.Mutex
+
+// ProgressEvent is written to stdout for every progress report when -json
+// is given
+type ProgressEvent struct {
+	Event   string
+	Label   string
+	Bytes   int64
+	Total   int64
+	Rate    float64
+	ETA     float64
+	Elapsed float64
+	Done    bool
+}
+
+// Progress tracks the number of bytes written through a stream and reports
+// it periodically. On a terminal a single line is updated in place,
+// otherwise a log line is printed now and then
+type Progress struct {
+	label   string
+	total   int64
+	written int64
+	start   time.Time
+	tty     bool
+	done    chan bool
+	wg      sync.WaitGroup
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// progressEnabled reports whether progress is shown. By default that is only
+// on a terminal, so runs from cron don't log a line every 30 seconds
+func progressEnabled() bool {
+	if *jsonFlag || verbosity > 1 {
+		return true
+	}
+	return verbosity > 0 && isTerminal(os.Stderr)
+}
+
+// NewProgress starts reporting progress for a stream. Finish must be called
+// once the stream is complete
+func NewProgress(label string) *Progress {
+	p := &Progress{
+		label: label,
+		start: time.Now(),
+		tty:   isTerminal(os.Stderr),
+		done:  make(chan bool)}
+	p.wg.Add(1)
+	go p.run()
+	return p
+}
+
+// SetTotal sets the expected size of the stream, used for the percentage
+// and the ETA
+func (p *Progress) SetTotal(total int64) {
+	atomic.StoreInt64(&p.total, total)
+}
+
+type progressWriter struct {
+	w io.Writer
+	p *Progress
+}
+
+func (pw progressWriter) Write(b []byte) (n int, err error) {
+	n, err = pw.w.Write(b)
+	atomic.AddInt64(&pw.p.written, int64(n))
+	return
+}
+
+// Writer returns a writer that passes everything to w while counting it
+func (p *Progress) Writer(w io.Writer) io.Writer {
+	return progressWriter{w, p}
+}
+
+func (p *Progress) run() {
+	defer p.wg.Done()
+	interval := progressLogInterval
+	if p.tty && verbosity > 0 {
+		interval = progressTTYInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.report(false)
+		case <-p.done:
+			p.report(true)
+			return
+		}
+	}
+}
+
+func (p *Progress) Finish() {
+	close(p.done)
+	p.wg.Wait()
+}
+
+func (p *Progress) report(done bool) {
+	written := atomic.LoadInt64(&p.written)
+	total := atomic.LoadInt64(&p.total)
+	elapsed := time.Since(p.start)
+	var rate float64
+	if elapsed > 0 {
+		rate = float64(written) / elapsed.Seconds()
+	}
+	var eta time.Duration
+	if total > written && rate > 0 {
+		eta = time.Duration(float64(total-written) / rate * float64(time.Second))
+	}
+	if *jsonFlag {
+		jsonMutex.Lock()
+		json.NewEncoder(os.Stdout).Encode(ProgressEvent{
+			Event:   "progress",
+			Label:   p.label,
+			Bytes:   written,
+			Total:   total,
+			Rate:    rate,
+			ETA:     eta.Seconds(),
+			Elapsed: elapsed.Seconds(),
+			Done:    done})
+		jsonMutex.Unlock()
+	}
+	if verbosity == 0 {
+		return
+	}
+	line := fmt.Sprintf("%s: %s", p.label, formatSize(written))
+	if total > 0 {
+		percent := 100 * float64(written) / float64(total)
+		if percent > 99 && !done {
+			percent = 99
+		}
+		line += fmt.Sprintf(" of ~%s (%.0f%%)", formatSize(total), percent)
+	}
+	line += fmt.Sprintf(" %s/s", formatSize(int64(rate)))
+	if done {
+		line += fmt.Sprintf(" in %s", elapsed.Truncate(time.Second))
+	} else if eta > 0 {
+		line += fmt.Sprintf(" ETA %s", eta.Truncate(time.Second))
+	}
+	if p.tty {
+		fmt.Fprintf(os.Stderr, "\r\x1b[K%s", line)
+		if done {
+			fmt.Fprintln(os.Stderr)
+		}
+	} else {
+		log.Println(line)
+	}
+}
+
+// NewSendProgress starts reporting progress for a btrfs send of
+// snapshotPath. The expected size is estimated in the background
+func NewSendProgress(label string, snapshotPath string, parentPath string) *Progress {
+	p := NewProgress(label)
+	go func() {
+		size, err := estimateSendSize(snapshotPath, parentPath)
+		if err != nil {
+			if verbosity > 1 {
+				log.Printf("Unable to estimate size of send stream: %s\n", err.Error())
+			}
+			return
+		}
+		p.SetTotal(size)
+	}()
+	return p
+}
+
+// estimateSendSize estimates the size of the stream that btrfs send will
+// produce by summing the extents in a stream generated with --no-data
+func estimateSendSize(snapshotPath string, parentPath string) (size int64, err error) {
+	args := []string{"send", "--no-data"}
+	if parentPath != "" {
+		args = append(args, "-p", parentPath)
+	}
+	args = append(args, snapshotPath)
+	cmd := exec.Command(btrfsBin, args...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return
+	}
+	err = cmd.Start()
+	if err != nil {
+		return
+	}
+	size, err = sumUpdateExtents(out)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return
+	}
+	err = cmd.Wait()
+	return
+}
+
+// sumUpdateExtents adds up the size attribute of every update extent
+// command in a send stream
+func sumUpdateExtents(rd io.Reader) (size int64, err error) {
+	_, err = sendstream.ReadAll(rd, func(cmd sendstream.Command) error {
+		if cmd.Type == sendstream.CmdUpdateExtent {
+			extent, _ := cmd.Uint64(sendstream.AttrSize)
+			size += int64(extent)
+		}
+		return nil
+	})
+	return
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Range of protocol versions understood by this build. Bump
+// protocolMaxVersion when the meaning of existing messages changes. New
+// optional features should be added as capabilities instead
+const (
+	protocolMinVersion int = 1
+	protocolMaxVersion int = 1
+)
+
+const (
+	CapSnappy    string = "snappy"
+	CapPrune     string = "prune"
+	CapResume    string = "resume"
+	CapChecksum  string = "sha256"
+	CapUUID      string = "uuid"
+	CapHashFiles string = "hashfiles"
+	CapSend      string = "send"
+	CapPins      string = "pins"
+)
+
+var capabilities = []string{CapSnappy, CapPrune, CapResume, CapChecksum, CapUUID, CapHashFiles, CapSend, CapPins}
+
+const (
+	CodecNone   string = "none"
+	CodecSnappy string = "snappy"
+)
+
+const (
+	OpCheck     string = "check"
+	OpReceive   string = "receive"
+	OpPrune     string = "prune"
+	OpResume    string = "resume"
+	OpDiscard   string = "discard"
+	OpInfo      string = "info"
+	OpHashFiles string = "hashfiles"
+	OpSend      string = "send"
+	OpPins      string = "pins"
+)
+
+// Every message is sent as a frame consisting of a one byte type, a four
+// byte big endian length and the payload
+const (
+	frameHello    byte = 'H'
+	frameRequest  byte = 'Q'
+	frameResponse byte = 'R'
+	frameData     byte = 'D'
+	frameEnd      byte = 'E'
+)
+
+const maxFrameSize uint32 = 16 << 20
+
+var errLegacyProtocol = errors.New("Remote does not support the framed protocol")
+
+type Hello struct {
+	MinVersion   int
+	MaxVersion   int
+	Capabilities []string
+}
+
+type Request struct {
+	Op          string
+	Destination string
+	Timestamp   string
+	Parent      string
+	Limits      Limits
+	Codec       string
+	Resume      bool
+	Offset      int64
+	Paths       []string
+	Pin         bool
+	Pins        []Pin
+	// Unpin lets OpPins remove the pins replicated by earlier requests that
+	// are no longer in Pins. Servers with a retention policy clear it
+	Unpin bool
+}
+
+type Response struct {
+	Error      string
+	Timestamps []string
+	Partials   []PartialTransfer
+	Offset     int64
+	Digest     string
+	Subvolumes []SubvolumeInfo
+	Hashes     []string
+}
+
+type rpcConn struct {
+	rd      *bufio.Reader
+	wr      *bufio.Writer
+	closer  io.Closer
+	Version int
+	caps    map[string]bool
+	// received holds the snapshots received on the server side of the
+	// connection
+	received []Snapshot
+	// readOnly is set on the server side of the restricted sender, which
+	// must neither lock nor create anything in the snapshot directories
+	readOnly bool
+}
+
+func newRPCConn(rd io.Reader, wr io.Writer, closer io.Closer) *rpcConn {
+	return &rpcConn{
+		rd:     bufio.NewReader(rd),
+		wr:     bufio.NewWriter(wr),
+		closer: closer}
+}
+
+func (conn *rpcConn) Close() error {
+	if conn.closer == nil {
+		return nil
+	}
+	return conn.closer.Close()
+}
+
+// Kill stops the remote command, if there is one, so that Close doesn't wait
+// for a remote that is blocked writing something nobody reads
+func (conn *rpcConn) Kill() {
+	if killer, ok := conn.closer.(interface {
+		Kill() error
+	}); ok {
+		killer.Kill()
+	}
+}
+
+func (conn *rpcConn) writeFrame(typ byte, payload []byte) (err error) {
+	var header [5]byte
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	_, err = conn.wr.Write(header[:])
+	if err != nil {
+		return
+	}
+	_, err = conn.wr.Write(payload)
+	return
+}
+
+func (conn *rpcConn) readFrame() (typ byte, payload []byte, err error) {
+	var header [5]byte
+	_, err = io.ReadFull(conn.rd, header[:])
+	if err != nil {
+		return
+	}
+	typ = header[0]
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxFrameSize {
+		err = fmt.Errorf("Frame of %d bytes exceeds maximum size", size)
+		return
+	}
+	payload = make([]byte, size)
+	_, err = io.ReadFull(conn.rd, payload)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+func (conn *rpcConn) writeJSON(typ byte, v interface{}) (err error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	err = conn.writeFrame(typ, payload)
+	if err != nil {
+		return
+	}
+	return conn.wr.Flush()
+}
+
+func (conn *rpcConn) readJSON(typ byte, v interface{}) (err error) {
+	t, payload, err := conn.readFrame()
+	if err != nil {
+		return
+	}
+	if t != typ {
+		err = fmt.Errorf("Expected frame '%c', got '%c'", typ, t)
+		return
+	}
+	return json.Unmarshal(payload, v)
+}
+
+// handshake exchanges Hello messages and settles on the highest protocol
+// version and the set of capabilities both sides support
+func (conn *rpcConn) handshake() (err error) {
+	writeErr := conn.writeJSON(frameHello, Hello{
+		MinVersion:   protocolMinVersion,
+		MaxVersion:   protocolMaxVersion,
+		Capabilities: capabilities})
+	// An older remote exits as soon as it sees the unknown flag, so the
+	// write may fail. Reading tells the two cases apart
+	var hello Hello
+	err = conn.readJSON(frameHello, &hello)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = errLegacyProtocol
+	}
+	if err != nil {
+		return
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	conn.Version = protocolMaxVersion
+	if hello.MaxVersion < conn.Version {
+		conn.Version = hello.MaxVersion
+	}
+	if conn.Version < protocolMinVersion || conn.Version < hello.MinVersion {
+		err = fmt.Errorf("No common protocol version Local (%d-%d) Remote (%d-%d)", protocolMinVersion, protocolMaxVersion, hello.MinVersion, hello.MaxVersion)
+		return
+	}
+	conn.caps = make(map[string]bool)
+	local := make(map[string]bool)
+	for _, c := range capabilities {
+		local[c] = true
+	}
+	for _, c := range hello.Capabilities {
+		if local[c] {
+			conn.caps[c] = true
+		}
+	}
+	return
+}
+
+// Has reports whether both sides of the connection support capability c
+func (conn *rpcConn) Has(c string) bool {
+	return conn.caps[c]
+}
+
+type dataWriter struct {
+	conn *rpcConn
+}
+
+// Write sends p as a single data frame
+func (w dataWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > int(maxFrameSize) {
+			chunk = chunk[:maxFrameSize]
+		}
+		err = w.conn.writeFrame(frameData, chunk)
+		if err != nil {
+			return
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return
+}
+
+// Close marks the end of the data stream
+func (w dataWriter) Close() error {
+	return w.CloseDigest("")
+}
+
+// CloseDigest marks the end of the data stream and passes along the digest
+// of the stream, which the receiver compares with its own
+func (w dataWriter) CloseDigest(digest string) (err error) {
+	err = w.conn.writeFrame(frameEnd, []byte(digest))
+	if err != nil {
+		return
+	}
+	return w.conn.wr.Flush()
+}
+
+// DataWriter returns a writer that sends a stream as data frames. The stream
+// must be terminated with Close or CloseDigest
+func (conn *rpcConn) DataWriter() dataWriter {
+	return dataWriter{conn}
+}
+
+type dataReader struct {
+	conn   *rpcConn
+	buf    []byte
+	done   bool
+	digest string
+}
+
+func (r *dataReader) Read(p []byte) (n int, err error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		var typ byte
+		typ, r.buf, err = r.conn.readFrame()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return
+		}
+		switch typ {
+		case frameData:
+		case frameEnd:
+			r.done = true
+			r.digest = string(r.buf)
+			r.buf = nil
+		default:
+			return 0, fmt.Errorf("Unexpected frame '%c' in data stream", typ)
+		}
+	}
+	n = copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return
+}
+
+// Digest returns the digest sent by the other side at the end of the
+// stream. It is empty if the end hasn't been reached or the sender didn't
+// include one
+func (r *dataReader) Digest() string {
+	return r.digest
+}
+
+// DataReader returns a reader for a stream sent with DataWriter. It returns
+// io.EOF once the end of the stream is reached
+func (conn *rpcConn) DataReader() *dataReader {
+	return &dataReader{conn: conn}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// Pull copies the snapshots of a source host into a local directory. The
+// source runs incrbtrfs as the restricted sender, so it never needs
+// credentials for the backup server
+type Pull struct {
+	Source       RemoteSnapshotsLoc
+	SnapshotsLoc SnapshotsLoc
+}
+
+func (pull Pull) Print() {
+	log.Printf("Pull Source='%s'\n", pull.Source.String())
+	log.Printf("Snapshot Dir='%s' (%s)\n", pull.SnapshotsLoc.Directory, pull.SnapshotsLoc.Limits.String())
+}
+
+// Run fetches the newest snapshot of the source if it isn't there yet,
+// incrementally on a snapshot both sides have when possible, and cleans up
+// the local snapshots according to the limits
+func (pull Pull) Run() (err error) {
+	err = os.MkdirAll(pull.SnapshotsLoc.Directory, dirMode)
+	if err != nil {
+		return
+	}
+	lock, err := NewDirLock(pull.SnapshotsLoc.Directory)
+	if err != nil {
+		return
+	}
+	defer lock.Unlock()
+	sourceTimestamps, err := pull.Source.GetTimestamps()
+	if err != nil {
+		return
+	}
+	if len(sourceTimestamps) == 0 {
+		if verbosity > 0 {
+			log.Printf("No snapshots on '%s'\n", pull.Source.String())
+		}
+		return
+	}
+	sort.Sort(Timestamps(sourceTimestamps))
+	timestamp := sourceTimestamps[len(sourceTimestamps)-1]
+	if _, errTmp := os.Stat(Snapshot{pull.SnapshotsLoc, timestamp}.Path()); errTmp == nil {
+		if verbosity > 0 {
+			log.Printf("%s already pulled\n", string(timestamp))
+		}
+		return
+	}
+	if verbosity > 0 {
+		log.Printf("Pulling %s\n", string(timestamp))
+	}
+	err = pull.Source.Fetch(pull.SnapshotsLoc, timestamp)
+	if err != nil {
+		return
+	}
+	timestamps, err := pull.SnapshotsLoc.ReadTimestampsDir()
+	if err != nil {
+		return
+	}
+	_, err = pull.SnapshotsLoc.CleanUp(timestamp, timestamps)
+	return
+}
+
+// senderOps are the only operations the restricted sender accepts
+var senderOps = map[string]bool{OpCheck: true, OpSend: true}
+
+// authorizeSender allows listing and sending read-only snapshots in dirs.
+// The destination of the request is replaced by its resolved path, so that
+// a symlink can't lead outside of dirs
+func authorizeSender(request *Request, dirs []string) (err error) {
+	if !senderOps[request.Op] {
+		return fmt.Errorf("Operation '%s' is not allowed by the sender", request.Op)
+	}
+	if !path.IsAbs(request.Destination) {
+		return fmt.Errorf("Directory '%s' is not an absolute path", request.Destination)
+	}
+	resolved, err := resolvePath(request.Destination)
+	if err != nil {
+		return
+	}
+	allowed := false
+	for _, dir := range dirs {
+		if isSubdir(dir, resolved) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("Directory '%s' is not allowed by the sender", request.Destination)
+	}
+	request.Destination = resolved
+	if request.Op != OpSend {
+		return
+	}
+	snapshotsLoc := SnapshotsLoc{Directory: request.Destination}
+	for _, timestamp := range []string{request.Timestamp, request.Parent} {
+		if timestamp == "" {
+			continue
+		}
+		_, err = parseTimestamp(Timestamp(timestamp))
+		if err != nil {
+			return
+		}
+		var info SubvolumeInfo
+		info, err = getSubvolumeInfo(Snapshot{snapshotsLoc, Timestamp(timestamp)}.Path())
+		if err != nil {
+			return fmt.Errorf("%s is not a snapshot in '%s'", timestamp, request.Destination)
+		}
+		if !info.ReadOnly {
+			return fmt.Errorf("%s in '%s' is not read-only", timestamp, request.Destination)
+		}
+	}
+	return
+}
+
+// runSender serves requests from a backup server pulling snapshots. It is
+// meant to be used as the forced command of the server's ssh key, with the
+// snapshot directories that may be read as arguments
+func runSender() {
+	if len(flag.Args()) < 2 {
+		log.Println("Must specify at least one directory in sender mode")
+		os.Exit(1)
+	}
+	var dirs []string
+	for _, dir := range flag.Args()[1:] {
+		dir, err := filepath.Abs(dir)
+		if err == nil {
+			dir, err = resolvePath(dir)
+		}
+		if err != nil {
+			log.Println(err.Error())
+			os.Exit(1)
+		}
+		dirs = append(dirs, dir)
+	}
+	conn := newRPCConn(os.Stdin, os.Stdout, nil)
+	conn.readOnly = true
+	err := serveRPC(conn, func(request *Request) error {
+		return authorizeSender(request, dirs)
+	})
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+	"time"
+)
+
+type rateLimitedWriter struct {
+	w       io.Writer
+	rate    int64
+	start   time.Time
+	written int64
+}
+
+// newRateLimitedWriter returns a writer that passes everything to w, pausing
+// as needed to keep the average rate at or below rate bytes per second
+func newRateLimitedWriter(w io.Writer, rate int64) io.Writer {
+	return &rateLimitedWriter{w: w, rate: rate}
+}
+
+func (rl *rateLimitedWriter) Write(p []byte) (n int, err error) {
+	// Time spent idle, such as waiting for btrfs send to start, doesn't
+	// build up credit for more than a second of data sent at full speed
+	expected := time.Duration(float64(rl.written) / float64(rl.rate) * float64(time.Second))
+	if rl.start.IsZero() || time.Since(rl.start)-expected > time.Second {
+		rl.start = time.Now()
+		rl.written = 0
+	}
+	// Write in pieces of at most a tenth of a second worth of data so the
+	// output stays smooth
+	chunkSize := int(rl.rate / 10)
+	if chunkSize < 1 {
+		chunkSize = 1
+	}
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		var m int
+		m, err = rl.w.Write(chunk)
+		n += m
+		rl.written += int64(m)
+		if err != nil {
+			return
+		}
+		p = p[m:]
+		expected := time.Duration(float64(rl.written) / float64(rl.rate) * float64(time.Second))
+		if elapsed := time.Since(rl.start); expected > elapsed {
+			time.Sleep(expected - elapsed)
+		}
+	}
+	return
+}
+
+// limitWriter returns w limited to the bandwidth limit of the remote, if it
+// has one. It wraps what is written to the remote, so the limit applies to
+// the compressed stream
+func (remote RemoteSnapshotsLoc) limitWriter(w io.Writer) io.Writer {
+	if remote.BWLimit > 0 {
+		return newRateLimitedWriter(w, remote.BWLimit)
+	}
+	return w
+}
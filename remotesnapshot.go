@@ -5,29 +5,123 @@ import (
 	"fmt"
 	"github.com/golang/snappy"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path"
 	"strconv"
+	"time"
+)
+
+const (
+	TransportSSH string = "ssh"
+	TransportTLS string = "tls"
 )
 
 type RemoteSnapshotsLoc struct {
 	Host         string
 	Port         string
 	User         string
+	Identity     string
+	SSHOptions   []string
 	Exec         string
+	Transport    string
+	Cert         string
+	Key          string
+	CA           string
+	Resume       bool
+	BWLimit      int64
+	Windows      []TimeWindow
+	Pull         bool
 	SnapshotsLoc SnapshotsLoc
 }
 
+// InWindow reports whether sending to the remote is allowed at time t
+func (remote RemoteSnapshotsLoc) InWindow(t time.Time) bool {
+	if len(remote.Windows) == 0 {
+		return true
+	}
+	for _, window := range remote.Windows {
+		if window.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// LastAllowed returns the latest time up to t at which sending to the remote
+// was allowed. Snapshots taken after it can't have been sent yet
+func (remote RemoteSnapshotsLoc) LastAllowed(t time.Time) time.Time {
+	if remote.InWindow(t) {
+		return t
+	}
+	// Windows are given in minutes, so the minute before the end of the
+	// most recent one is the last time inside it
+	t = t.Truncate(time.Minute)
+	for i := 0; i < 24*60; i++ {
+		if remote.InWindow(t.Add(-time.Minute)) {
+			return t
+		}
+		t = t.Add(-time.Minute)
+	}
+	return t
+}
+
 func (remote RemoteSnapshotsLoc) GetTimestamps() (timestamps []Timestamp, err error) {
-	sshPath := remote.Host
-	if remote.User != "" {
-		sshPath = remote.User + "@" + sshPath
+	timestamps, _, err = remote.Check()
+	return
+}
+
+// Check returns the timestamps available on the remote and any interrupted
+// transfers it holds
+func (remote RemoteSnapshotsLoc) Check() (timestamps []Timestamp, partials []PartialTransfer, err error) {
+	var timestampStrs []string
+	conn, err := remote.dialRPC()
+	if err == errLegacyProtocol && remote.Transport != TransportTLS {
+		if verbosity > 1 {
+			log.Println("Remote doesn't support the framed protocol. Using -receive -check")
+		}
+		var checkStr RemoteCheck
+		checkStr, err = remote.sshCheck()
+		if err != nil {
+			return
+		}
+		if checkStr.Version != version {
+			err = fmt.Errorf("Incompatible Version Local (%d) != Remote (%d)", version, checkStr.Version)
+			return
+		}
+		timestampStrs = checkStr.Timestamps
+	} else if err != nil {
+		return
+	} else {
+		defer conn.Close()
+		var response Response
+		response, err = conn.Call(Request{
+			Op:          OpCheck,
+			Destination: remote.SnapshotsLoc.Directory}, nil)
+		if err != nil {
+			return
+		}
+		timestampStrs = response.Timestamps
+		partials = response.Partials
+	}
+	for _, timestampStr := range timestampStrs {
+		timestamp := Timestamp(timestampStr)
+		_, err := parseTimestamp(timestamp)
+		if err != nil {
+			continue
+		}
+		timestamps = append(timestamps, timestamp)
 	}
+	return
+}
+
+func (remote RemoteSnapshotsLoc) sshCheck() (checkStr RemoteCheck, err error) {
 	var receiveCheckOut []byte
-	receiveCheckCmd := exec.Command("ssh", "-p", remote.Port, sshPath, remote.Exec, "-receive", "-check", "-destination", remote.SnapshotsLoc.Directory)
+	receiveCheckCmd := remote.Command("-receive", "-check", "-destination", remote.SnapshotsLoc.Directory)
 	if verbosity > 1 {
+		printCommand(receiveCheckCmd)
 		receiveCheckCmd.Stderr = os.Stderr
 	}
 	receiveCheckOut, err = receiveCheckCmd.Output()
@@ -36,24 +130,11 @@ func (remote RemoteSnapshotsLoc) GetTimestamps() (timestamps []Timestamp, err er
 		log.Println(string(receiveCheckOut))
 		return
 	}
-	var checkStr RemoteCheck
 	err = json.Unmarshal(receiveCheckOut, &checkStr)
 	if err != nil {
 		log.Println("Failed to read ReceiveCheck JSON")
 		return
 	}
-	if checkStr.Version != version {
-		err = fmt.Errorf("Incompatible Version Local (%d) != Remote (%d)", version, checkStr.Version)
-		return
-	}
-	for _, timestampStr := range checkStr.Timestamps {
-		timestamp := Timestamp(timestampStr)
-		_, err := parseTimestamp(timestamp)
-		if err != nil {
-			continue
-		}
-		timestamps = append(timestamps, timestamp)
-	}
 	return
 }
 
@@ -64,7 +145,10 @@ func PassSignal(cmd *exec.Cmd, c chan os.Signal) {
 	}
 }
 
-func (remote RemoteSnapshotsLoc) RemoteReceive(in io.Reader, timestamp Timestamp) (retRunner CmdRunner) {
+// RemoteReceive sends the uncompressed snapshot stream read from in to the
+// remote, compressing it if both sides support it. The pins of the remote
+// are replaced by pins first, so its clean up keeps the same snapshots
+func (remote RemoteSnapshotsLoc) RemoteReceive(in io.Reader, timestamp Timestamp, parent Timestamp, pins []Pin) (retRunner CmdRunner) {
 	retRunner = NewCmdRunner()
 	go func() {
 		if verbosity > 2 {
@@ -76,20 +160,94 @@ func (remote RemoteSnapshotsLoc) RemoteReceive(in io.Reader, timestamp Timestamp
 			retRunner.Done <- err
 			return
 		}
-		sshPath := remote.Host
-		if remote.User != "" {
-			sshPath = remote.User + "@" + sshPath
+		conn, err := remote.dialRPC()
+		if err == errLegacyProtocol && remote.Transport != TransportTLS {
+			if verbosity > 1 {
+				log.Println("Remote doesn't support the framed protocol. Using -receive")
+			}
+			runner := remote.legacyReceive(in, timestamp)
+			retRunner.Started <- <-runner.Started
+			retRunner.Done <- <-runner.Done
+			return
+		}
+		if err != nil {
+			retRunner.Started <- err
+			retRunner.Done <- err
+			return
+		}
+		if conn.Has(CapPins) {
+			_, err = conn.Call(Request{
+				Op:          OpPins,
+				Destination: remote.SnapshotsLoc.Directory,
+				Pins:        pins,
+				Unpin:       true}, nil)
+			if err != nil {
+				conn.Close()
+				retRunner.Started <- err
+				retRunner.Done <- err
+				return
+			}
+		} else if verbosity > 0 {
+			log.Println("Remote doesn't support replicating pins")
+		}
+		retRunner.Started <- nil
+		codec := CodecNone
+		if !*noCompressionFlag && conn.Has(CapSnappy) {
+			codec = CodecSnappy
 		}
-		receiveArgs := []string{sshPath, "-p", remote.Port, remote.Exec, "-receive", "-destination", remote.SnapshotsLoc.Directory, "-timestamp", string(timestamp)}
 		if verbosity > 2 {
-			receiveArgs = append(receiveArgs, "-debug")
-		} else if verbosity == 2 {
-			receiveArgs = append(receiveArgs, "-verbose")
-		} else if verbosity == 0 {
-			receiveArgs = append(receiveArgs, "-quiet")
+			log.Printf("RemoteReceive: Codec %s\n", codec)
+		}
+		if remote.Resume && conn.Has(CapResume) {
+			err = remote.resumeReceive(conn, in, timestamp, parent, codec)
+		} else {
+			_, err = conn.Call(Request{
+				Op:          OpReceive,
+				Destination: remote.SnapshotsLoc.Directory,
+				Timestamp:   string(timestamp),
+				Parent:      string(parent),
+				Limits:      remote.SnapshotsLoc.Limits,
+				Codec:       codec}, in)
 		}
+		// Over ssh the remote forwards what it has received before it exits.
+		// Waiting for it keeps the session, which carries its stderr, open
+		// until it is done
+		conn.Close()
+		retRunner.Done <- err
+	}()
+	return
+}
+
+// compressReader returns a reader of the snappy compressed contents of in
+func compressReader(in io.Reader) *io.PipeReader {
+	rd, wr := io.Pipe()
+	go func() {
+		sw := snappy.NewBufferedWriter(wr)
+		_, err := io.Copy(sw, in)
+		if err == nil {
+			err = sw.Close()
+		}
+		wr.CloseWithError(err)
+	}()
+	return rd
+}
+
+// legacyReceive runs incrbtrfs -receive on the remote for versions that
+// predate the framed protocol
+func (remote RemoteSnapshotsLoc) legacyReceive(in io.Reader, timestamp Timestamp) (retRunner CmdRunner) {
+	retRunner = NewCmdRunner()
+	go func() {
+		receiveArgs := []string{"-receive", "-destination", remote.SnapshotsLoc.Directory, "-timestamp", string(timestamp)}
+		receiveArgs = append(receiveArgs, remoteVerbosityArgs()...)
 		if *noCompressionFlag {
 			receiveArgs = append(receiveArgs, "-noCompression")
+		} else {
+			rd := compressReader(in)
+			defer rd.Close()
+			in = rd
+		}
+		if remote.BWLimit > 0 {
+			in = io.TeeReader(in, newRateLimitedWriter(ioutil.Discard, remote.BWLimit))
 		}
 		if remote.SnapshotsLoc.Limits.Hourly > 0 {
 			receiveArgs = append(receiveArgs, "-hourly", strconv.Itoa(remote.SnapshotsLoc.Limits.Hourly))
@@ -103,7 +261,7 @@ func (remote RemoteSnapshotsLoc) RemoteReceive(in io.Reader, timestamp Timestamp
 		if remote.SnapshotsLoc.Limits.Monthly > 0 {
 			receiveArgs = append(receiveArgs, "-monthly", strconv.Itoa(remote.SnapshotsLoc.Limits.Monthly))
 		}
-		cmd := exec.Command("ssh", receiveArgs...)
+		cmd := remote.Command(receiveArgs...)
 		if verbosity > 1 {
 			printCommand(cmd)
 		}
@@ -140,7 +298,17 @@ func (remote RemoteSnapshotsLoc) RemoteReceive(in io.Reader, timestamp Timestamp
 }
 
 func (remote RemoteSnapshotsLoc) SendSnapshot(snapshot Snapshot, parent Timestamp) (err error) {
+	err = remote.sendSnapshot(snapshot, parent)
+	if err == errResumeMismatch {
+		log.Println(err.Error() + ". Restarting transfer")
+		err = remote.sendSnapshot(snapshot, parent)
+	}
+	return
+}
+
+func (remote RemoteSnapshotsLoc) sendSnapshot(snapshot Snapshot, parent Timestamp) (err error) {
 	var sendCmd *exec.Cmd
+	var parentPath string
 	if parent == "" {
 		if verbosity > 1 {
 			log.Println("Performing full send/receive")
@@ -150,7 +318,7 @@ func (remote RemoteSnapshotsLoc) SendSnapshot(snapshot Snapshot, parent Timestam
 		if verbosity > 1 {
 			log.Println("Performing incremental send/receive")
 		}
-		parentPath := path.Join(path.Dir(snapshot.Path()), string(parent))
+		parentPath = path.Join(path.Dir(snapshot.Path()), string(parent))
 		sendCmd = exec.Command(btrfsBin, "send", "-p", parentPath, snapshot.Path())
 	}
 	if verbosity > 1 {
@@ -158,22 +326,30 @@ func (remote RemoteSnapshotsLoc) SendSnapshot(snapshot Snapshot, parent Timestam
 	}
 	sendRd, sendWr := io.Pipe()
 	defer sendRd.Close()
+	sendCmd.Stdout = sendWr
+	if remote.Host == "" {
+		// Remote hosts limit the connection. A local remote has none, so
+		// the stream itself is limited
+		sendCmd.Stdout = remote.limitWriter(sendWr)
+	}
+	if progressEnabled() {
+		progress := NewSendProgress("Sending "+string(snapshot.timestamp), snapshot.Path(), parentPath)
+		defer progress.Finish()
+		sendCmd.Stdout = progress.Writer(sendCmd.Stdout)
+	}
+	pins, err := snapshot.snapshotsLoc.activePins(time.Now())
+	if err != nil {
+		return
+	}
 	var recvRunner CmdRunner
-	var compOut *snappy.Writer
-	closeComp := false
 	if remote.Host == "" {
-		sendCmd.Stdout = sendWr
+		err = remote.SnapshotsLoc.SyncPins(pins, true)
+		if err != nil {
+			return
+		}
 		recvRunner = remote.SnapshotsLoc.ReceiveAndCleanUp(sendRd, snapshot.timestamp)
 	} else {
-		if *noCompressionFlag {
-			sendCmd.Stdout = sendWr
-			recvRunner = remote.RemoteReceive(sendRd, snapshot.timestamp)
-		} else {
-			compOut = snappy.NewBufferedWriter(sendWr)
-			closeComp = true
-			sendCmd.Stdout = compOut
-			recvRunner = remote.RemoteReceive(sendRd, snapshot.timestamp)
-		}
+		recvRunner = remote.RemoteReceive(sendRd, snapshot.timestamp, parent, pins)
 	}
 	sendRunner := RunCommand(sendCmd)
 
@@ -196,17 +372,23 @@ func (remote RemoteSnapshotsLoc) SendSnapshot(snapshot Snapshot, parent Timestam
 		if err != nil {
 			log.Println("Error running btrfs send")
 		}
-		if closeComp {
-			compOut.Close()
+		// Closing with the error makes sure a failed send is never
+		// mistaken for a complete stream
+		sendWr.CloseWithError(err)
+		recvErr := <-recvRunner.Done
+		if err == nil && recvErr != nil {
+			log.Println("Error running btrfs receive")
+			err = recvErr
 		}
-		sendWr.Close()
-		<-recvRunner.Done
 		return
 	case err = <-recvRunner.Done:
 		if err != nil {
 			log.Println("Error running btrfs receive")
 		}
 		sendRunner.Signal <- os.Kill
+		// Nothing reads the stream anymore. Closing the pipe unblocks the
+		// copy of the send output so that the command can be waited on
+		sendRd.Close()
 		<-sendRunner.Done
 		return
 	}
@@ -226,7 +408,12 @@ func (remote RemoteSnapshotsLoc) sendSnapshotUsingParent(localSnapshot Snapshot,
 			return
 		}
 	} else {
-		remoteTimestamps, err = remote.GetTimestamps()
+		var partials []PartialTransfer
+		remoteTimestamps, partials, err = remote.Check()
+		if err != nil {
+			return
+		}
+		remoteTimestamps, err = remote.resumePartials(localSnapshot, partials, localTimestamps, remoteTimestamps)
 		if err != nil {
 			return
 		}
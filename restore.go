@@ -0,0 +1,291 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var remoteFlag = flag.String("remote", "", "Remote directory to restore or fetch from")
+var discardCurrentFlag = flag.Bool("discardCurrent", false, "Delete the current subvolume when restoring instead of keeping it")
+
+// copyFile copies a regular file, keeping its permissions. The copy shares
+// the data of the original when both are on the same btrfs filesystem
+func copyFile(src string, dst string, mode os.FileMode) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return
+	}
+	if reflink(out, in) == nil {
+		return out.Close()
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return
+	}
+	err = out.Close()
+	return
+}
+
+// moveSnapshotsDir moves the contents of a snapshots directory from one
+// subvolume to another. Plain directories can't be renamed across subvolumes,
+// so only the snapshots themselves are renamed and everything else is
+// recreated at dst
+func moveSnapshotsDir(src string, dst string) (err error) {
+	err = os.MkdirAll(dst, dirMode)
+	if err != nil {
+		return
+	}
+	entries, err := ioutil.ReadDir(src)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		srcPath := path.Join(src, entry.Name())
+		dstPath := path.Join(dst, entry.Name())
+		switch {
+		case entry.Mode()&os.ModeSymlink != 0:
+			var target string
+			target, err = os.Readlink(srcPath)
+			if err != nil {
+				return
+			}
+			os.Remove(dstPath)
+			err = os.Symlink(target, dstPath)
+		case entry.IsDir() && isSubvolume(srcPath):
+			err = os.Rename(srcPath, dstPath)
+		case entry.IsDir():
+			err = moveSnapshotsDir(srcPath, dstPath)
+		default:
+			err = copyFile(srcPath, dstPath, entry.Mode())
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func isMountPoint(dir string) (mounted bool, err error) {
+	mountPoints, err := readMountPoints("/proc/mounts")
+	if err != nil {
+		return
+	}
+	for _, mountPoint := range mountPoints {
+		if mountPoint == dir {
+			return true, nil
+		}
+	}
+	return
+}
+
+// Restore replaces the subvolume with a writable snapshot of the snapshot
+// with the given timestamp. The current subvolume is renamed and kept next
+// to it unless discardCurrent is set. Snapshots stored inside the subvolume
+// are moved into the restored one
+func (subvolume Subvolume) Restore(timestamp Timestamp, discardCurrent bool) (err error) {
+	dir, err := filepath.Abs(subvolume.Directory)
+	if err != nil {
+		return
+	}
+	if dir == "/" {
+		err = fmt.Errorf("Restoring the root subvolume is not supported")
+		return
+	}
+	mounted, err := isMountPoint(dir)
+	if err != nil {
+		return
+	}
+	if mounted {
+		err = fmt.Errorf("'%s' is mounted as a separate subvolume and can't be replaced. Create a writable snapshot of '%s' and mount it instead", dir, Snapshot{subvolume.SnapshotsLoc, timestamp}.Path())
+		return
+	}
+	snapshot := Snapshot{subvolume.SnapshotsLoc, timestamp}
+	now := string(getCurrentTimestamp())
+	tmpDir := path.Join(path.Dir(dir), "."+path.Base(dir)+".restore-"+now)
+	asideDir := dir + ".pre-restore-" + now
+
+	btrfsCmd := exec.Command(btrfsBin, "subvolume", "snapshot", snapshot.Path(), tmpDir)
+	if verbosity > 1 {
+		printCommand(btrfsCmd)
+		btrfsCmd.Stdout = os.Stderr
+		btrfsCmd.Stderr = os.Stderr
+	}
+	err = btrfsCmd.Run()
+	if err != nil {
+		return
+	}
+	snapshotsDir, err := filepath.Abs(subvolume.SnapshotsLoc.Directory)
+	if err != nil {
+		return
+	}
+	var snapshotsRel string
+	if isSubdir(dir, snapshotsDir) {
+		snapshotsRel = strings.TrimPrefix(strings.TrimPrefix(snapshotsDir, dir), "/")
+		// The snapshot holds a stale copy of the snapshots directory in which
+		// the snapshots themselves are empty directories
+		err = os.RemoveAll(path.Join(tmpDir, snapshotsRel))
+		if err != nil {
+			return
+		}
+	}
+	err = os.Rename(dir, asideDir)
+	if err != nil {
+		if errTmp := deleteSubvolume(tmpDir); errTmp != nil {
+			log.Println(errTmp.Error())
+		}
+		return
+	}
+	err = os.Rename(tmpDir, dir)
+	if err != nil {
+		if errTmp := os.Rename(asideDir, dir); errTmp != nil {
+			log.Println(errTmp.Error())
+		}
+		return
+	}
+	if verbosity > 0 {
+		log.Printf("Restored '%s' to %s\n", dir, string(timestamp))
+	}
+	if snapshotsRel != "" {
+		var lock DirLock
+		lock, err = NewDirLock(snapshotsDir)
+		if err != nil {
+			return
+		}
+		defer lock.Unlock()
+		oldSnapshotsDir := path.Join(asideDir, snapshotsRel)
+		err = moveSnapshotsDir(oldSnapshotsDir, snapshotsDir)
+		if err != nil {
+			err = fmt.Errorf("Failed to move snapshots from '%s': %s", oldSnapshotsDir, err.Error())
+			return
+		}
+		err = os.RemoveAll(oldSnapshotsDir)
+		if err != nil {
+			return
+		}
+	}
+	if discardCurrent {
+		err = deleteSubvolume(asideDir)
+	} else if verbosity > 0 {
+		log.Printf("Previous contents kept in '%s'\n", asideDir)
+	}
+	return
+}
+
+// findSubvolume returns the subvolume configured for dir. dir can be empty
+// if only one subvolume is configured
+func findSubvolume(subvolumes []Subvolume, dir string) (subvolume Subvolume, err error) {
+	if dir == "" {
+		if len(subvolumes) != 1 {
+			err = fmt.Errorf("Subvolume required. The config file has %d subvolumes", len(subvolumes))
+			return
+		}
+		return subvolumes[0], nil
+	}
+	for _, subvolume = range subvolumes {
+		if path.Clean(subvolume.Directory) == path.Clean(dir) {
+			return
+		}
+	}
+	err = fmt.Errorf("Subvolume '%s' is not in the config file", dir)
+	return
+}
+
+// findRemote returns the remote of the subvolume with the given directory,
+// optionally prefixed by the host as in host:directory. name can be empty if
+// the subvolume has only one remote
+func findRemote(subvolume Subvolume, name string) (remote RemoteSnapshotsLoc, err error) {
+	if name == "" {
+		if len(subvolume.Remotes) != 1 {
+			err = fmt.Errorf("Remote required. '%s' has %d remotes", subvolume.Directory, len(subvolume.Remotes))
+			return
+		}
+		return subvolume.Remotes[0], nil
+	}
+	for _, remote = range subvolume.Remotes {
+		if remote.SnapshotsLoc.Directory == name || remote.String() == name {
+			return
+		}
+	}
+	err = fmt.Errorf("Remote '%s' is not configured for '%s'", name, subvolume.Directory)
+	return
+}
+
+func runRestore() {
+	if flag.NArg() < 2 || flag.NArg() > 3 {
+		log.Println("Config file required")
+		os.Exit(1)
+	}
+	config, err := parseFile(flag.Arg(1))
+	if err != nil {
+		log.Println("Erroring parsing file")
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	subvolume, err := findSubvolume(parseConfig(config), flag.Arg(2))
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	lock, err := NewDirLock(subvolume.SnapshotsLoc.Directory)
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	defer lock.Unlock()
+
+	var timestamps []Timestamp
+	var remote RemoteSnapshotsLoc
+	if *remoteFlag == "" {
+		timestamps, err = subvolume.SnapshotsLoc.ReadTimestampsDir()
+	} else {
+		remote, err = findRemote(subvolume, *remoteFlag)
+		if err == nil && remote.Host == "" {
+			timestamps, err = remote.SnapshotsLoc.ReadTimestampsDir()
+		} else if err == nil {
+			timestamps, err = remote.GetTimestamps()
+		}
+	}
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	timestamp, err := timestampAtOrBefore(timestamps, *timestampFlag)
+	if err == nil && timestamp == "" {
+		err = fmt.Errorf("No snapshot found at or before '%s'", *timestampFlag)
+	}
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	if *remoteFlag != "" {
+		if _, errTmp := os.Stat(Snapshot{subvolume.SnapshotsLoc, timestamp}.Path()); os.IsNotExist(errTmp) {
+			if verbosity > 0 {
+				log.Printf("Fetching %s from '%s'\n", string(timestamp), remote.String())
+			}
+			err = remote.Fetch(subvolume.SnapshotsLoc, timestamp)
+			if err != nil {
+				log.Println(err.Error())
+				os.Exit(1)
+			}
+		}
+	}
+	err = subvolume.Restore(timestamp, *discardCurrentFlag)
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+}
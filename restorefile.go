@@ -0,0 +1,156 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// FICLONE from linux/fs.h
+const ficlone uintptr = 0x40049409
+
+// reflink makes dst share the extents of src. It fails unless both files
+// are on the same btrfs filesystem
+func reflink(dst *os.File, src *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// snapshotFile returns the path of relPath in the snapshot. Its parent
+// directories in the snapshot must not be symlinks, which could lead to a
+// file outside of the snapshot
+func (s Snapshot) snapshotFile(relPath string) (file string, err error) {
+	relPath = strings.TrimPrefix(path.Clean("/"+relPath), "/")
+	if relPath == "" {
+		err = fmt.Errorf("No file given")
+		return
+	}
+	components := strings.Split(relPath, "/")
+	file = s.Path()
+	for _, component := range components[:len(components)-1] {
+		file = path.Join(file, component)
+		var fi os.FileInfo
+		fi, err = os.Lstat(file)
+		if err != nil {
+			return
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			err = fmt.Errorf("'%s' is a symlink", file)
+			return
+		}
+		if !fi.IsDir() {
+			err = fmt.Errorf("'%s' is not a directory", file)
+			return
+		}
+	}
+	file = path.Join(file, components[len(components)-1])
+	return
+}
+
+// RestoreFile copies the version of relPath in the snapshot to dst, keeping
+// its permissions and modification time. The copy is written next to dst and
+// renamed into place. An existing dst is kept as dst.pre-restore-<timestamp>
+// unless discardCurrent is set
+func (s Snapshot) RestoreFile(relPath string, dst string, discardCurrent bool) (err error) {
+	src, err := s.snapshotFile(relPath)
+	if err != nil {
+		return
+	}
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return
+	}
+	now := string(getCurrentTimestamp())
+	tmp := path.Join(path.Dir(dst), "."+path.Base(dst)+".restore-"+now)
+	switch {
+	case fi.Mode().IsRegular():
+		err = copyFile(src, tmp, fi.Mode().Perm())
+	case fi.Mode()&os.ModeSymlink != 0:
+		var target string
+		target, err = os.Readlink(src)
+		if err == nil {
+			err = os.Symlink(target, tmp)
+		}
+	default:
+		err = fmt.Errorf("'%s' is not a regular file or a symlink", src)
+		return
+	}
+	if err == nil && os.Geteuid() == 0 {
+		if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+			err = os.Lchown(tmp, int(stat.Uid), int(stat.Gid))
+		}
+	}
+	// Changing the owner clears the setuid and setgid bits, so the mode is
+	// set afterwards
+	if err == nil && fi.Mode().IsRegular() {
+		err = os.Chmod(tmp, fi.Mode())
+		if err == nil {
+			err = os.Chtimes(tmp, fi.ModTime(), fi.ModTime())
+		}
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+	if _, errTmp := os.Lstat(dst); errTmp == nil && !discardCurrent {
+		asidePath := dst + ".pre-restore-" + now
+		err = os.Rename(dst, asidePath)
+		if err != nil {
+			os.Remove(tmp)
+			return
+		}
+		if verbosity > 0 {
+			log.Printf("Previous version kept in '%s'\n", asidePath)
+		}
+	}
+	err = os.Rename(tmp, dst)
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+	if verbosity > 0 {
+		log.Printf("Restored '%s' from %s\n", dst, string(s.timestamp))
+	}
+	return
+}
+
+func runRestoreFile() {
+	snapshotsLoc, relPath, versions, lock := loadFileHistory(false)
+	defer lock.Unlock()
+	var timestamps []Timestamp
+	for _, version := range versions {
+		if version.Exists {
+			timestamps = append(timestamps, Timestamp(version.Timestamp))
+		}
+	}
+	timestamp, err := timestampAtOrBefore(timestamps, *timestampFlag)
+	if err == nil && timestamp == "" {
+		err = fmt.Errorf("'%s' is not in any snapshot at or before '%s'", relPath, *timestampFlag)
+	}
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	dst, err := filepath.Abs(flag.Arg(2))
+	if err == nil && *destinationFlag != "" {
+		dst = *destinationFlag
+		if fi, errTmp := os.Stat(dst); errTmp == nil && fi.IsDir() {
+			dst = path.Join(dst, path.Base(relPath))
+		}
+	}
+	if err == nil {
+		err = Snapshot{snapshotsLoc, timestamp}.RestoreFile(relPath, dst, *discardCurrentFlag)
+	}
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRestoreFile(t *testing.T) {
+	dir := t.TempDir()
+	snapshot := Snapshot{SnapshotsLoc{Directory: path.Join(dir, "snapshots")}, "20160101_000000"}
+	makeDirs(t, snapshot.Path(), "dir")
+	makeDirs(t, dir, "outside", "restored")
+	makeLinks(t, snapshot.Path(), map[string]string{"link": "../../../outside", "file-link": "dir/file"})
+	for _, file := range []string{path.Join(snapshot.Path(), "dir/file"), path.Join(dir, "outside/secret")} {
+		err := ioutil.WriteFile(file, []byte("data"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.Chmod(path.Join(snapshot.Path(), "dir/file"), 0755|os.ModeSetgid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		relPath string
+		ok      bool
+	}{
+		{"dir/file", true},
+		{"file-link", true},
+		{"../../outside/secret", false},
+		{"link/secret", false},
+		{"dir/file/file", false},
+		{"", false},
+	}
+	for i, test := range tests {
+		dst := path.Join(dir, "restored", string(rune('a'+i)))
+		err := snapshot.RestoreFile(test.relPath, dst, false)
+		if (err == nil) != test.ok {
+			t.Errorf("RestoreFile(%q) error = %v, want ok %v", test.relPath, err, test.ok)
+		}
+		if _, errTmp := os.Lstat(dst); (errTmp == nil) != test.ok {
+			t.Errorf("RestoreFile(%q) created '%s': %v, want %v", test.relPath, dst, errTmp == nil, test.ok)
+		}
+	}
+
+	fi, err := os.Lstat(path.Join(dir, "restored/a"))
+	if err == nil && fi.Mode() != 0755|os.ModeSetgid {
+		t.Errorf("Restored file has mode %v, want %v", fi.Mode(), 0755|os.ModeSetgid)
+	}
+	fi, err = os.Lstat(path.Join(dir, "restored/b"))
+	if err == nil && fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Restored symlink has mode %v", fi.Mode())
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// restrictedOps are the operations allowed in restricted mode. Resuming and
+// discarding interrupted transfers and replicating pins are part of receiving.
+// Listing the received snapshots with their UUIDs is needed to forward to the
+// receiver incrementally, and together with hashing files in them to verify
+// the receiver. Neither changes anything
+var restrictedOps = map[string]bool{OpCheck: true, OpReceive: true, OpResume: true, OpDiscard: true, OpPins: true, OpInfo: true, OpHashFiles: true}
+
+// splitCommand splits a command line as run by the shell into words. It
+// understands the quoting used by shellQuote as well as double quotes and
+// backslash escapes, but no other shell syntax
+func splitCommand(command string) (words []string, err error) {
+	var word []rune
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, c := range command {
+		switch {
+		case escaped:
+			word = append(word, c)
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word = append(word, c)
+			}
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else if c == '\\' {
+				escaped = true
+			} else {
+				word = append(word, c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == '\\':
+			escaped = true
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, string(word))
+				word = word[:0]
+				inWord = false
+			}
+		case strings.ContainsRune(";&|<>`$(){}*?#~", c):
+			err = fmt.Errorf("Unsupported character '%c' in command", c)
+			return
+		default:
+			word = append(word, c)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		err = fmt.Errorf("Unterminated quote in command")
+		return
+	}
+	if inWord {
+		words = append(words, string(word))
+	}
+	return
+}
+
+// restrictedCommand holds the options of a command requested by a client in
+// restricted mode
+type restrictedCommand struct {
+	rpc           bool
+	receive       bool
+	check         bool
+	destination   string
+	timestamp     string
+	noCompression bool
+	limits        Limits
+	verbosity     int
+}
+
+// parseRestrictedCommand parses the command a client asked ssh to run. The
+// words before the first flag, such as the path of incrbtrfs or sudo, are
+// skipped. Only the flags used by the receiving side are accepted
+func parseRestrictedCommand(command string) (cmd restrictedCommand, err error) {
+	words, err := splitCommand(command)
+	if err != nil {
+		return
+	}
+	i := 0
+	for i < len(words) && !strings.HasPrefix(words[i], "-") {
+		i++
+	}
+	flags := flag.NewFlagSet("restricted", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	quiet := flags.Bool("quiet", false, "")
+	verbose := flags.Bool("verbose", false, "")
+	debug := flags.Bool("debug", false, "")
+	flags.BoolVar(&cmd.rpc, "rpc", false, "")
+	flags.BoolVar(&cmd.receive, "receive", false, "")
+	flags.BoolVar(&cmd.check, "check", false, "")
+	flags.StringVar(&cmd.destination, "destination", "", "")
+	flags.StringVar(&cmd.timestamp, "timestamp", "", "")
+	flags.BoolVar(&cmd.noCompression, "noCompression", false, "")
+	flags.IntVar(&cmd.limits.Hourly, "hourly", 0, "")
+	flags.IntVar(&cmd.limits.Daily, "daily", 0, "")
+	flags.IntVar(&cmd.limits.Weekly, "weekly", 0, "")
+	flags.IntVar(&cmd.limits.Monthly, "monthly", 0, "")
+	err = flags.Parse(words[i:])
+	if err != nil {
+		return
+	}
+	if flags.NArg() > 0 || cmd.rpc == cmd.receive {
+		err = fmt.Errorf("Only check and receive are allowed")
+		return
+	}
+	cmd.verbosity = 1
+	if *debug {
+		cmd.verbosity = 3
+	} else if *verbose {
+		cmd.verbosity = 2
+	} else if *quiet {
+		cmd.verbosity = 0
+	}
+	return
+}
+
+// restrictedAuthorize returns the function serveRPC uses in restricted mode
+// to check each request of the client with the given names
+func restrictedAuthorize(config ServerConfig, names []string) func(request *Request) error {
+	return func(request *Request) error {
+		if !restrictedOps[request.Op] {
+			return fmt.Errorf("Operation '%s' is not allowed", request.Op)
+		}
+		dir, destination, err := config.Authorize(names, request.Destination)
+		if err != nil {
+			return err
+		}
+		request.Destination = dir
+		// Clients in restricted mode can only ever add pins
+		request.Unpin = false
+		destination.ApplyRestrictedPolicy(request, time.Now())
+		return nil
+	}
+}
+
+// runRestricted is meant to be used as the forced command of a client's key
+// in authorized_keys. It runs the command the client asked for, found in
+// SSH_ORIGINAL_COMMAND, only if it checks or receives into a destination of
+// the server config that the client is allowed to use
+func runRestricted() {
+	if flag.NArg() < 2 || flag.NArg() > 3 {
+		log.Println("Server config file required")
+		os.Exit(1)
+	}
+	config, err := parseServerFile(flag.Arg(1))
+	if err != nil {
+		log.Println("Error parsing server config")
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	// Without a client name only destinations open to any client match
+	names := []string{}
+	if flag.NArg() == 3 {
+		names = append(names, flag.Arg(2))
+	}
+	command := os.Getenv("SSH_ORIGINAL_COMMAND")
+	cmd, err := parseRestrictedCommand(command)
+	if err != nil {
+		log.Printf("Command '%s' rejected: %s\n", command, err.Error())
+		os.Exit(1)
+	}
+	verbosity = cmd.verbosity
+
+	if cmd.rpc {
+		conn := newRPCConn(os.Stdin, os.Stdout, nil)
+		err = serveRPC(conn, restrictedAuthorize(config, names))
+		ignoreClientGone()
+		isErr := config.ForwardReceived(conn.received)
+		if err != nil {
+			log.Println(err.Error())
+			os.Exit(1)
+		}
+		if isErr {
+			os.Exit(1)
+		}
+		return
+	}
+
+	cmd.destination, _, err = config.Authorize(names, cmd.destination)
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	// The legacy receive modes read their options from the global flags and
+	// apply the policy of the server config themselves
+	*serverConfigFlag = flag.Arg(1)
+	*destinationFlag = cmd.destination
+	*timestampFlag = cmd.timestamp
+	*noCompressionFlag = cmd.noCompression
+	*hourlyFlag = cmd.limits.Hourly
+	*dailyFlag = cmd.limits.Daily
+	*weeklyFlag = cmd.limits.Weekly
+	*monthlyFlag = cmd.limits.Monthly
+	if cmd.check {
+		runRemoteCheck()
+	} else {
+		runRemote()
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveTestRPC serves requests checked by authorize over a pair of pipes and
+// returns the client end of the connection after the handshake
+func serveTestRPC(t *testing.T, authorize func(request *Request) error) *rpcConn {
+	clientRd, serverWr, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverRd, clientWr, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- serveRPC(newRPCConn(serverRd, serverWr, nil), authorize)
+		serverWr.Close()
+	}()
+	client := newRPCConn(clientRd, clientWr, clientWr)
+	t.Cleanup(func() {
+		client.Close()
+		err := <-done
+		if err != nil {
+			t.Errorf("Server: %s", err)
+		}
+		clientRd.Close()
+		serverRd.Close()
+	})
+	err = client.handshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestRestrictedForward(t *testing.T) {
+	dir := t.TempDir()
+	makeDirs(t, dir, "backups/host1/timestamp", "outside/timestamp")
+	config := writeServerConfig(t, dir, `
+[[destination]]
+directory = "`+dir+`/backups"
+clients = ["nas"]
+`)
+	conn := serveTestRPC(t, restrictedAuthorize(config, []string{"nas"}))
+	dest := path.Join(dir, "backups/host1")
+
+	// The requests a forward makes before sending the stream
+	_, err := conn.subvolumeInfos(dest)
+	if err != nil {
+		t.Errorf("Listing subvolumes: %s", err)
+	}
+	_, err = conn.Call(Request{Op: OpPins, Destination: dest, Unpin: true}, nil)
+	if err != nil {
+		t.Errorf("Replicating pins: %s", err)
+	}
+	_, err = conn.Call(Request{Op: OpCheck, Destination: dest}, nil)
+	if err != nil {
+		t.Errorf("Checking: %s", err)
+	}
+
+	_, err = conn.Call(Request{Op: OpPrune, Destination: dest}, nil)
+	if err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("Pruning gave error %v, want not allowed", err)
+	}
+	_, err = conn.subvolumeInfos(path.Join(dir, "outside"))
+	if err == nil || !strings.Contains(err.Error(), "not authorized") {
+		t.Errorf("Listing outside of the destinations gave error %v, want not authorized", err)
+	}
+}
+
+func TestRestrictedVerify(t *testing.T) {
+	dir := t.TempDir()
+	makeDirs(t, dir, "backups/host1/timestamp/20160101_000000")
+	err := ioutil.WriteFile(path.Join(dir, "backups/host1/timestamp/20160101_000000/file"), []byte("data"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := writeServerConfig(t, dir, `
+[[destination]]
+directory = "`+dir+`/backups"
+clients = ["host1"]
+`)
+	conn := serveTestRPC(t, restrictedAuthorize(config, []string{"host1"}))
+
+	response, err := conn.Call(Request{
+		Op:          OpHashFiles,
+		Destination: path.Join(dir, "backups/host1"),
+		Timestamp:   "20160101_000000",
+		Paths:       []string{"file", "missing", "../../../server.cfg"}}, nil)
+	if err != nil {
+		t.Fatalf("Hashing files: %s", err)
+	}
+	want := []string{"3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7", "", ""}
+	if !reflect.DeepEqual(response.Hashes, want) {
+		t.Errorf("Hashes %q, want %q", response.Hashes, want)
+	}
+
+	// Verifying a remote that hasn't received anything yet creates nothing
+	missing := path.Join(dir, "backups/host2")
+	infos, err := conn.subvolumeInfos(missing)
+	if err != nil || len(infos) != 0 {
+		t.Errorf("Listing a missing directory gave %v %v, want nothing", infos, err)
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("Listing created '%s'", missing)
+	}
+}
+
+func TestRestrictedPins(t *testing.T) {
+	dir := t.TempDir()
+	makeDirs(t, dir, "backups/host1")
+	config := writeServerConfig(t, dir, `
+[[destination]]
+directory = "`+dir+`/backups"
+clients = ["nas"]
+max_pin_age = "720h"
+`)
+	conn := serveTestRPC(t, restrictedAuthorize(config, []string{"nas"}))
+	dest := path.Join(dir, "backups/host1")
+	now := time.Now()
+	recent := Timestamp(now.Add(-24 * time.Hour).Format(timeFormat))
+	old := Timestamp(now.Add(-1000 * time.Hour).Format(timeFormat))
+	_, err := conn.Call(Request{Op: OpPins, Destination: dest, Pins: []Pin{
+		{Name: "recent", Timestamp: recent},
+		{Name: "old", Timestamp: old},
+	}}, nil)
+	if err != nil {
+		t.Fatalf("Replicating pins: %s", err)
+	}
+	pins, err := SnapshotsLoc{Directory: dest}.ReadPins()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0, _ := parseTimestamp(recent)
+	want := []Pin{{Name: "recent", Timestamp: recent, Expires: Timestamp(t0.Add(720 * time.Hour).Format(timeFormat))}}
+	if !reflect.DeepEqual(pins, want) {
+		t.Errorf("Pins %v, want %v", pins, want)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// The receiver persists its progress every resumeChunkSize bytes. An
+// interrupted transfer restarts from the last of these checkpoints
+const resumeChunkSize int64 = 64 << 20
+
+var errResumeMismatch = errors.New("Partial transfer doesn't match the snapshot stream")
+
+type PartialTransfer struct {
+	Timestamp string
+	Parent    string
+	Offset    int64
+}
+
+// partialState is stored next to the spooled stream. Offset is the number
+// of bytes of the stream known to be on disk and Hash the marshaled state
+// of the hash of those bytes
+type partialState struct {
+	Offset int64
+	Hash   []byte
+}
+
+func (snapshotsLoc SnapshotsLoc) partialDir(timestamp Timestamp, parent Timestamp) string {
+	name := string(timestamp) + "-"
+	if parent == "" {
+		name += "full"
+	} else {
+		name += string(parent)
+	}
+	return path.Join(snapshotsLoc.Directory, "partial", name)
+}
+
+// ReadPartials lists the interrupted transfers that can be resumed
+func (snapshotsLoc SnapshotsLoc) ReadPartials() (partials []PartialTransfer, err error) {
+	fileInfos, err := ioutil.ReadDir(path.Join(snapshotsLoc.Directory, "partial"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+	for _, fi := range fileInfos {
+		parts := strings.SplitN(fi.Name(), "-", 2)
+		if !fi.IsDir() || len(parts) != 2 {
+			continue
+		}
+		timestamp := Timestamp(parts[0])
+		parent := Timestamp(parts[1])
+		if parent == "full" {
+			parent = ""
+		}
+		_, err := parseTimestamp(timestamp)
+		if err != nil {
+			continue
+		}
+		// Listing is part of checking, so the spool is left as it is
+		offset, _, err := readPartialState(snapshotsLoc.partialDir(timestamp, parent))
+		if err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		partials = append(partials, PartialTransfer{
+			Timestamp: string(timestamp),
+			Parent:    string(parent),
+			Offset:    offset})
+	}
+	return
+}
+
+func (snapshotsLoc SnapshotsLoc) DiscardPartial(timestamp Timestamp, parent Timestamp) error {
+	if verbosity > 1 {
+		log.Printf("Discarding partial transfer of %s\n", string(timestamp))
+	}
+	return os.RemoveAll(snapshotsLoc.partialDir(timestamp, parent))
+}
+
+type partialSpool struct {
+	dir        string
+	file       *os.File
+	hash       hash.Hash
+	offset     int64
+	checkpoint int64
+}
+
+// readPartialState reads the last checkpoint of the partial transfer in dir
+// and restores the hash of the stream up to it. Without a checkpoint the
+// transfer starts from the beginning
+func readPartialState(dir string) (offset int64, h hash.Hash, err error) {
+	h = sha256.New()
+	data, err := ioutil.ReadFile(path.Join(dir, "state"))
+	if os.IsNotExist(err) {
+		return 0, h, nil
+	} else if err != nil {
+		return
+	}
+	var state partialState
+	err = json.Unmarshal(data, &state)
+	if err == nil {
+		err = h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state.Hash)
+	}
+	if err != nil {
+		err = fmt.Errorf("Invalid state for partial transfer '%s': %s", dir, err.Error())
+		return
+	}
+	offset = state.Offset
+	return
+}
+
+// openPartial opens the spooled stream for a transfer, creating it if
+// needed, and truncates it to the last checkpoint
+func (snapshotsLoc SnapshotsLoc) openPartial(timestamp Timestamp, parent Timestamp) (spool *partialSpool, err error) {
+	dir := snapshotsLoc.partialDir(timestamp, parent)
+	err = os.MkdirAll(dir, dirMode)
+	if err != nil {
+		return
+	}
+	spool = &partialSpool{dir: dir}
+	spool.offset, spool.hash, err = readPartialState(dir)
+	if err != nil {
+		return
+	}
+	spool.checkpoint = spool.offset
+	spool.file, err = os.OpenFile(path.Join(dir, "stream"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	err = spool.file.Truncate(spool.offset)
+	if err != nil {
+		spool.file.Close()
+		return
+	}
+	_, err = spool.file.Seek(spool.offset, io.SeekStart)
+	if err != nil {
+		spool.file.Close()
+	}
+	return
+}
+
+func (spool *partialSpool) Write(p []byte) (n int, err error) {
+	n, err = spool.file.Write(p)
+	spool.hash.Write(p[:n])
+	spool.offset += int64(n)
+	if err != nil {
+		return
+	}
+	if spool.offset-spool.checkpoint >= resumeChunkSize {
+		err = spool.Checkpoint()
+	}
+	return
+}
+
+// Checkpoint makes sure everything written so far is on disk and records
+// the offset to resume from
+func (spool *partialSpool) Checkpoint() (err error) {
+	err = spool.file.Sync()
+	if err != nil {
+		return
+	}
+	hashState, err := spool.hash.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return
+	}
+	data, err := json.Marshal(partialState{Offset: spool.offset, Hash: hashState})
+	if err != nil {
+		return
+	}
+	tmpFile := path.Join(spool.dir, "state.tmp")
+	err = ioutil.WriteFile(tmpFile, data, 0600)
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmpFile, path.Join(spool.dir, "state"))
+	if err != nil {
+		return
+	}
+	spool.checkpoint = spool.offset
+	return
+}
+
+// Digest returns the hex encoded SHA-256 of the stream written so far
+func (spool *partialSpool) Digest() string {
+	return hex.EncodeToString(spool.hash.Sum(nil))
+}
+
+func (spool *partialSpool) Close() error {
+	return spool.file.Close()
+}
+
+// ReceiveResumable appends the stream read from in to the spooled partial
+// transfer, which must currently hold offset bytes. Once the whole stream
+// has arrived its digest is compared with the one returned by sentDigest
+// and it is received from the spool and cleaned up like Receive. The caller
+// is expected to hold the lock on the directory
+func (snapshotsLoc SnapshotsLoc) ReceiveResumable(in io.Reader, timestamp Timestamp, parent Timestamp, offset int64, sentDigest func() string) (digest string, err error) {
+	spool, err := snapshotsLoc.openPartial(timestamp, parent)
+	if err != nil {
+		return
+	}
+	defer spool.Close()
+	if spool.offset != offset {
+		err = fmt.Errorf("Partial transfer is at offset %d, not %d", spool.offset, offset)
+		return
+	}
+	_, err = io.Copy(spool, in)
+	if err != nil {
+		if errTmp := spool.Checkpoint(); errTmp != nil {
+			log.Println(errTmp.Error())
+		}
+		if verbosity > 0 {
+			log.Printf("Transfer interrupted. Received %d bytes\n", spool.offset)
+		}
+		return
+	}
+	digest = spool.Digest()
+	err = verifyDigest(sentDigest(), digest)
+	if err == nil {
+		_, err = spool.file.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		err = snapshotsLoc.Receive(spool.file, timestamp, false, nil)
+	}
+	// A stream that doesn't match or that btrfs receive rejects is no use
+	// for resuming either
+	errTmp := snapshotsLoc.DiscardPartial(timestamp, parent)
+	if err == nil {
+		err = errTmp
+	}
+	return
+}
+
+// resumeReceive sends the stream for timestamp to the remote, skipping the
+// part that a previous attempt already transferred
+func (remote RemoteSnapshotsLoc) resumeReceive(conn *rpcConn, in io.Reader, timestamp Timestamp, parent Timestamp, codec string) (err error) {
+	request := Request{
+		Op:          OpResume,
+		Destination: remote.SnapshotsLoc.Directory,
+		Timestamp:   string(timestamp),
+		Parent:      string(parent)}
+	response, err := conn.Call(request, nil)
+	if err != nil {
+		return
+	}
+	h := sha256.New()
+	if response.Offset > 0 {
+		_, err = io.CopyN(h, in, response.Offset)
+		if err != nil {
+			return
+		}
+		if hex.EncodeToString(h.Sum(nil)) != response.Digest {
+			request.Op = OpDiscard
+			_, err = conn.Call(request, nil)
+			if err != nil {
+				return
+			}
+			return errResumeMismatch
+		}
+		if verbosity > 0 {
+			log.Printf("Resuming transfer at %d bytes\n", response.Offset)
+		}
+	}
+	request.Op = OpReceive
+	request.Limits = remote.SnapshotsLoc.Limits
+	request.Codec = codec
+	request.Resume = true
+	request.Offset = response.Offset
+	_, err = conn.CallHashed(request, in, h)
+	return
+}
+
+// resumePartials finishes the interrupted transfers reported by the remote
+// so that they can serve as parents, and discards the ones that can no
+// longer be completed. It returns remoteTimestamps with the completed
+// transfers added
+func (remote RemoteSnapshotsLoc) resumePartials(localSnapshot Snapshot, partials []PartialTransfer, localTimestamps []Timestamp, remoteTimestamps []Timestamp) ([]Timestamp, error) {
+	local := make(TimestampMap)
+	for _, timestamp := range localTimestamps {
+		local[timestamp] = true
+	}
+	for _, partial := range partials {
+		timestamp := Timestamp(partial.Timestamp)
+		parent := Timestamp(partial.Parent)
+		if timestamp == localSnapshot.timestamp {
+			continue
+		}
+		if remote.Resume && local[timestamp] && (parent == "" || local[parent]) {
+			if verbosity > 0 {
+				log.Printf("Resuming interrupted transfer of %s\n", partial.Timestamp)
+			}
+			err := remote.SendSnapshot(Snapshot{localSnapshot.snapshotsLoc, timestamp}, parent)
+			if err != nil {
+				return remoteTimestamps, err
+			}
+			remoteTimestamps = append(remoteTimestamps, timestamp)
+			continue
+		}
+		_, err := remote.call(Request{
+			Op:          OpDiscard,
+			Destination: remote.SnapshotsLoc.Directory,
+			Timestamp:   partial.Timestamp,
+			Parent:      partial.Parent})
+		if err != nil {
+			return remoteTimestamps, err
+		}
+	}
+	return remoteTimestamps, nil
+}
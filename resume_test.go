@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func sha256Hex(data string) string {
+	digest := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(digest[:])
+}
+
+// writePartial spools checkpointed followed by data written after the last
+// checkpoint, as a transfer interrupted before it could checkpoint again
+func writePartial(t *testing.T, snapshotsLoc SnapshotsLoc, timestamp Timestamp, parent Timestamp, checkpointed string, rest string) {
+	spool, err := snapshotsLoc.openPartial(timestamp, parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	_, err = spool.Write([]byte(checkpointed))
+	if err == nil {
+		err = spool.Checkpoint()
+	}
+	if err == nil {
+		_, err = spool.Write([]byte(rest))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPartialCheckpoint(t *testing.T) {
+	snapshotsLoc := SnapshotsLoc{Directory: t.TempDir()}
+	writePartial(t, snapshotsLoc, "20160102_000000", "20160101_000000", "abc", "def")
+
+	spool, err := snapshotsLoc.openPartial("20160102_000000", "20160101_000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	if spool.offset != 3 {
+		t.Errorf("Reopened at offset %d, want 3", spool.offset)
+	}
+	if digest := spool.Digest(); digest != sha256Hex("abc") {
+		t.Errorf("Digest after reopening %s, want that of the checkpointed data", digest)
+	}
+	data, err := ioutil.ReadFile(path.Join(spool.dir, "stream"))
+	if err != nil || string(data) != "abc" {
+		t.Errorf("Spool holds %q %v, want it truncated to the checkpoint", data, err)
+	}
+	_, err = spool.Write([]byte("xyz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest := spool.Digest(); digest != sha256Hex("abcxyz") {
+		t.Errorf("Digest after resuming %s, want that of the whole stream", digest)
+	}
+}
+
+func TestReadPartials(t *testing.T) {
+	snapshotsLoc := SnapshotsLoc{Directory: t.TempDir()}
+	partials, err := snapshotsLoc.ReadPartials()
+	if err != nil || len(partials) != 0 {
+		t.Errorf("ReadPartials without partial transfers gave %v %v", partials, err)
+	}
+	if _, err := os.Stat(path.Join(snapshotsLoc.Directory, "partial")); !os.IsNotExist(err) {
+		t.Errorf("ReadPartials created the partial directory")
+	}
+
+	writePartial(t, snapshotsLoc, "20160102_000000", "", "abc", "def")
+	makeDirs(t, snapshotsLoc.Directory, "partial/20160103_000000-20160102_000000", "partial/20160104_000000-full", "partial/invalid")
+	err = ioutil.WriteFile(path.Join(snapshotsLoc.partialDir("20160104_000000", ""), "state"), []byte("{"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partials, err = snapshotsLoc.ReadPartials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PartialTransfer{
+		{Timestamp: "20160102_000000", Offset: 3},
+		{Timestamp: "20160103_000000", Parent: "20160102_000000"},
+	}
+	if !reflect.DeepEqual(partials, want) {
+		t.Errorf("Partials %+v, want %+v", partials, want)
+	}
+	// Listing leaves the data after the checkpoint and creates no spools
+	data, err := ioutil.ReadFile(path.Join(snapshotsLoc.partialDir("20160102_000000", ""), "stream"))
+	if err != nil || string(data) != "abcdef" {
+		t.Errorf("Spool holds %q %v after listing, want it unchanged", data, err)
+	}
+	if _, err := os.Stat(path.Join(snapshotsLoc.partialDir("20160103_000000", "20160102_000000"), "stream")); !os.IsNotExist(err) {
+		t.Errorf("Listing created a spool")
+	}
+}
+
+func TestReceiveResumableMismatch(t *testing.T) {
+	snapshotsLoc := SnapshotsLoc{Directory: t.TempDir()}
+	writePartial(t, snapshotsLoc, "20160102_000000", "", "abc", "")
+	sentDigest := func() string { return sha256Hex("abcdef") }
+
+	// The sender has to continue from where the spool is
+	_, err := snapshotsLoc.ReceiveResumable(strings.NewReader("cdef"), "20160102_000000", "", 2, sentDigest)
+	if err == nil || !strings.Contains(err.Error(), "offset") {
+		t.Errorf("Resuming at the wrong offset gave error %v", err)
+	}
+	partials, err := snapshotsLoc.ReadPartials()
+	if err != nil || len(partials) != 1 || partials[0].Offset != 3 {
+		t.Errorf("Partials %+v %v after resuming at the wrong offset, want it kept at 3", partials, err)
+	}
+
+	// A stream that doesn't match what was sent can't be resumed either
+	digest, err := snapshotsLoc.ReceiveResumable(strings.NewReader("xyz"), "20160102_000000", "", 3, sentDigest)
+	if err == nil || !strings.Contains(err.Error(), "Checksum mismatch") {
+		t.Errorf("Mismatched stream gave error %v", err)
+	}
+	if digest != sha256Hex("abcxyz") {
+		t.Errorf("Digest %s, want that of the spooled stream", digest)
+	}
+	if _, err := os.Stat(snapshotsLoc.partialDir("20160102_000000", "")); !os.IsNotExist(err) {
+		t.Errorf("Mismatched partial transfer wasn't discarded")
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/golang/snappy"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+)
+
+// readOps are the operations that only read the snapshot directory
+var readOps = map[string]bool{OpInfo: true, OpHashFiles: true}
+
+func handleRequest(conn *rpcConn, request Request, authorize func(request *Request) error) (response Response, err error) {
+	var data *dataReader
+	if request.Op == OpReceive {
+		// Whatever happens the rest of the stream has to be consumed before
+		// the response can be read by the client
+		data = conn.DataReader()
+		defer io.Copy(ioutil.Discard, data)
+	}
+	if request.Op == OpSend {
+		// The client reads the stream before the response, so the stream has
+		// to be terminated even if the request fails
+		dw := conn.DataWriter()
+		defer func() {
+			if response.Digest == "" {
+				dw.Close()
+			}
+		}()
+	}
+	err = authorize(&request)
+	if err != nil {
+		return
+	}
+	snapshotsLoc := SnapshotsLoc{Directory: request.Destination, Limits: request.Limits}
+	if conn.readOnly {
+		// Sending only reads read-only snapshots, which btrfs refuses to
+		// delete while they are sent. Without a lock the snapshots of the
+		// source itself can still be taken during a long send
+		_, err = os.Stat(path.Join(snapshotsLoc.Directory, "timestamp"))
+		if err != nil {
+			return
+		}
+	} else if _, errStat := os.Stat(snapshotsLoc.Directory); readOps[request.Op] && os.IsNotExist(errStat) {
+		// Locking would create the directory, but there is nothing to read
+		// and verifying a remote shouldn't change it
+	} else {
+		var lock DirLock
+		lock, err = NewDirLock(snapshotsLoc.Directory)
+		if err != nil {
+			return
+		}
+		defer lock.Unlock()
+	}
+	timestamp := Timestamp(request.Timestamp)
+	parent := Timestamp(request.Parent)
+	switch request.Op {
+	case OpReceive, OpResume, OpDiscard, OpHashFiles, OpSend:
+		_, err = parseTimestamp(timestamp)
+		if err != nil {
+			return
+		}
+		if parent != "" {
+			_, err = parseTimestamp(parent)
+			if err != nil {
+				return
+			}
+		}
+	}
+	switch request.Op {
+	case OpCheck:
+		var checkStr RemoteCheck
+		checkStr, err = newRemoteCheck(snapshotsLoc)
+		if err != nil {
+			return
+		}
+		response.Timestamps = checkStr.Timestamps
+		if conn.Has(CapResume) {
+			response.Partials, err = snapshotsLoc.ReadPartials()
+		}
+	case OpReceive:
+		var in io.Reader = data
+		switch request.Codec {
+		case "", CodecNone:
+		case CodecSnappy:
+			in = snappy.NewReader(in)
+		default:
+			err = fmt.Errorf("Unsupported codec '%s'", request.Codec)
+			return
+		}
+		if request.Resume {
+			response.Digest, err = snapshotsLoc.ReceiveResumable(in, timestamp, parent, request.Offset, data.Digest)
+		} else {
+			h := sha256.New()
+			in = io.TeeReader(in, h)
+			err = snapshotsLoc.Receive(in, timestamp, false, func() error {
+				// btrfs receive may stop reading before the end of the
+				// stream, but all of it has to be part of the digest
+				_, err := io.Copy(ioutil.Discard, in)
+				if err != nil {
+					return err
+				}
+				response.Digest = hex.EncodeToString(h.Sum(nil))
+				return verifyDigest(data.Digest(), response.Digest)
+			})
+		}
+		if err == nil && request.Pin {
+			err = snapshotsLoc.PinTimestamp(timestamp)
+		}
+		if err == nil {
+			conn.received = append(conn.received, Snapshot{snapshotsLoc, timestamp})
+		}
+	case OpResume:
+		var spool *partialSpool
+		spool, err = snapshotsLoc.openPartial(timestamp, parent)
+		if err != nil {
+			return
+		}
+		spool.Close()
+		response.Offset = spool.offset
+		response.Digest = spool.Digest()
+	case OpDiscard:
+		err = snapshotsLoc.DiscardPartial(timestamp, parent)
+	case OpPins:
+		err = snapshotsLoc.SyncPins(request.Pins, request.Unpin)
+	case OpPrune:
+		err = snapshotsLoc.Prune()
+	case OpInfo:
+		response.Subvolumes, err = snapshotsLoc.ReadSubvolumeInfos()
+	case OpHashFiles:
+		response.Hashes, err = Snapshot{snapshotsLoc, timestamp}.HashFiles(request.Paths)
+	case OpSend:
+		response.Digest, err = Snapshot{snapshotsLoc, timestamp}.SendStream(parent, request.Codec, conn.DataWriter())
+	default:
+		err = fmt.Errorf("Unknown operation '%s'", request.Op)
+	}
+	return
+}
+
+// serveRPC handles requests on conn until the client closes it. authorize is
+// called with every request before it is handled and may adjust it
+func serveRPC(conn *rpcConn, authorize func(request *Request) error) (err error) {
+	err = conn.handshake()
+	if err != nil {
+		return
+	}
+	if verbosity > 2 {
+		log.Printf("Protocol version %d\n", conn.Version)
+	}
+	for {
+		var request Request
+		err = conn.readJSON(frameRequest, &request)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return
+		}
+		if verbosity > 1 {
+			log.Printf("Request %s '%s'\n", request.Op, request.Destination)
+		}
+		response, err := handleRequest(conn, request, authorize)
+		if err != nil {
+			log.Println(err.Error())
+			response.Error = err.Error()
+		}
+		err = conn.writeJSON(frameResponse, response)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func runRPC() {
+	config, err := loadServerPolicy()
+	if err != nil {
+		log.Println("Error parsing server config")
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	conn := newRPCConn(os.Stdin, os.Stdout, nil)
+	err = serveRPC(conn, func(request *Request) error {
+		config.ApplyPolicy(request)
+		return nil
+	})
+	ignoreClientGone()
+	isErr := config.ForwardReceived(conn.received)
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	if isErr {
+		os.Exit(1)
+	}
+}
+
+// verifyDigest compares the digest of a stream given by the sender with the
+// one computed by the receiver. Senders that don't provide a digest aren't
+// checked
+func verifyDigest(sent string, received string) error {
+	if sent != "" && sent != received {
+		return fmt.Errorf("Checksum mismatch. Expected %s, got %s", sent, received)
+	}
+	return nil
+}
+
+// Call sends request and, if in is not nil, the stream read from it encoded
+// with request.Codec. It returns the response of the remote
+func (conn *rpcConn) Call(request Request, in io.Reader) (response Response, err error) {
+	return conn.CallHashed(request, in, sha256.New())
+}
+
+// CallHashed is like Call but continues the digest of the stream from h,
+// which may already have been fed the beginning of the stream
+func (conn *rpcConn) CallHashed(request Request, in io.Reader, h hash.Hash) (response Response, err error) {
+	err = conn.writeJSON(frameRequest, request)
+	if err != nil {
+		return
+	}
+	var digest string
+	if in != nil {
+		dw := conn.DataWriter()
+		var w io.Writer = dw
+		var sw *snappy.Writer
+		if request.Codec == CodecSnappy {
+			sw = snappy.NewBufferedWriter(dw)
+			w = sw
+		}
+		_, err = io.Copy(w, io.TeeReader(in, h))
+		if err != nil {
+			return
+		}
+		if sw != nil {
+			err = sw.Close()
+			if err != nil {
+				return
+			}
+		}
+		digest = hex.EncodeToString(h.Sum(nil))
+		err = dw.CloseDigest(digest)
+		if err != nil {
+			return
+		}
+	}
+	err = conn.readJSON(frameResponse, &response)
+	if err != nil {
+		return
+	}
+	if response.Error != "" {
+		err = errors.New(response.Error)
+		return
+	}
+	if in != nil && conn.Has(CapChecksum) {
+		err = verifyDigest(digest, response.Digest)
+		if err == nil && verbosity > 1 {
+			log.Printf("Verified checksum %s\n", digest)
+		}
+	}
+	return
+}
+
+type cmdCloser struct {
+	cmd   *exec.Cmd
+	stdin io.Closer
+}
+
+func (c cmdCloser) Close() error {
+	c.stdin.Close()
+	return c.cmd.Wait()
+}
+
+func (c cmdCloser) Kill() error {
+	return c.cmd.Process.Kill()
+}
+
+// handshakeStderr holds back the remote's stderr until the handshake is
+// done, so the usage message of an older remote isn't shown when falling
+// back to the legacy protocol. Failing to pass it on to our own stderr, which
+// happens when this is a server forwarding for a client that has been
+// interrupted, must not stop the remote
+type handshakeStderr struct {
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	released bool
+}
+
+func (w *handshakeStderr) Write(p []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.released {
+		os.Stderr.Write(p)
+		return len(p), nil
+	}
+	return w.buf.Write(p)
+}
+
+func (w *handshakeStderr) Release() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.released = true
+	os.Stderr.Write(w.buf.Bytes())
+	w.buf.Reset()
+}
+
+func remoteVerbosityArgs() []string {
+	if verbosity > 2 {
+		return []string{"-debug"}
+	} else if verbosity == 2 {
+		return []string{"-verbose"}
+	} else if verbosity == 0 {
+		return []string{"-quiet"}
+	}
+	return nil
+}
+
+// call connects to the remote and sends a single request without a stream
+func (remote RemoteSnapshotsLoc) call(request Request) (response Response, err error) {
+	conn, err := remote.dialRPC()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	return conn.Call(request, nil)
+}
+
+// dialRPC connects to the remote and performs the handshake. It returns
+// errLegacyProtocol if the remote is an older version that only understands
+// the -receive flags
+func (remote RemoteSnapshotsLoc) dialRPC() (conn *rpcConn, err error) {
+	if remote.Transport == TransportTLS {
+		tlsConn, err := remote.dialTLS()
+		if err != nil {
+			return nil, err
+		}
+		conn = newRPCConn(tlsConn, remote.limitWriter(tlsConn), tlsConn)
+		err = conn.handshake()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	rpcArg := "-rpc"
+	if remote.Pull {
+		rpcArg = "sender"
+	}
+	cmd := remote.Command(append(remoteVerbosityArgs(), rpcArg)...)
+	if verbosity > 1 {
+		printCommand(cmd)
+	}
+	stderr := &handshakeStderr{}
+	cmd.Stderr = stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return
+	}
+	err = cmd.Start()
+	if err != nil {
+		return
+	}
+	conn = newRPCConn(stdout, remote.limitWriter(stdin), cmdCloser{cmd, stdin})
+	err = conn.handshake()
+	if err == errLegacyProtocol {
+		conn.Close()
+		return nil, err
+	}
+	stderr.Release()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if verbosity > 2 {
+		log.Printf("Protocol version %d\n", conn.Version)
+	}
+	return
+}
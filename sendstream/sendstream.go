@@ -0,0 +1,238 @@
+// Package sendstream decodes the stream produced by btrfs send. Versions 1
+// and 2 of the format are supported, as is version 3, which only adds a
+// command for fs-verity
+package sendstream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+)
+
+const magic string = "btrfs-stream\x00"
+
+// HeaderSize is the size of the stream header holding the magic and the
+// version
+const HeaderSize int = 17
+
+// CommandHeaderSize is the size of the header in front of every command
+const CommandHeaderSize int = 10
+
+// MaxVersion is the newest version of the stream format that can be read
+const MaxVersion uint32 = 3
+
+// maxCommandSize returns the largest command including its header that the
+// kernel writes in a stream of the given version. Version 1 commands fit in
+// 64 KiB. Later versions make room for 128 KiB of compressed data plus 16 KiB,
+// rounded up to the page size, which is at most 64 KiB
+func maxCommandSize(version uint32) uint32 {
+	if version == 1 {
+		return 64 << 10
+	}
+	return 192 << 10
+}
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// CRC computes the checksum btrfs uses for send commands. It is crc32c with
+// a seed of 0 and no final inversion
+func CRC(data ...[]byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, p := range data {
+		crc = crc32.Update(crc, castagnoliTable, p)
+	}
+	return ^crc
+}
+
+// Command is a single command of a send stream
+type Command struct {
+	Type CommandType
+	// Attrs maps attribute types to their raw values
+	Attrs map[Attribute][]byte
+	// Offset is the position of the command in the stream
+	Offset int64
+	// Size is the size of the command including its header
+	Size int64
+}
+
+// String returns the value of a string attribute such as a path
+func (cmd Command) String(attr Attribute) string {
+	return string(cmd.Attrs[attr])
+}
+
+// Uint64 returns the value of an integer attribute
+func (cmd Command) Uint64(attr Attribute) (value uint64, ok bool) {
+	data, ok := cmd.Attrs[attr]
+	if !ok || len(data) != 8 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(data), true
+}
+
+// Path returns the path the command applies to
+func (cmd Command) Path() string {
+	return cmd.String(AttrPath)
+}
+
+// parseAttrs splits the payload of a command into its attributes. From
+// version 2 on the data attribute has no length and takes up the rest of the
+// command
+func parseAttrs(version uint32, payload []byte) (attrs map[Attribute][]byte, err error) {
+	attrs = make(map[Attribute][]byte)
+	for len(payload) > 0 {
+		if len(payload) < 2 {
+			err = fmt.Errorf("Truncated attribute header")
+			return
+		}
+		typ := Attribute(binary.LittleEndian.Uint16(payload[0:2]))
+		if version >= 2 && typ == AttrData {
+			attrs[typ] = payload[2:]
+			return
+		}
+		if len(payload) < 4 {
+			err = fmt.Errorf("Truncated attribute header")
+			return
+		}
+		attrLen := int(binary.LittleEndian.Uint16(payload[2:4]))
+		payload = payload[4:]
+		if attrLen > len(payload) {
+			err = fmt.Errorf("Attribute %s longer than its command", typ)
+			return
+		}
+		attrs[typ] = payload[:attrLen]
+		payload = payload[attrLen:]
+	}
+	return
+}
+
+// Reader reads the commands of a send stream one at a time
+type Reader struct {
+	rd        io.Reader
+	Version   uint32
+	offset    int64
+	commands  int
+	done      bool
+	cmdHeader []byte
+	payload   []byte
+}
+
+// NewReader reads the stream header from rd and returns a Reader for the
+// commands that follow it
+func NewReader(rd io.Reader) (r *Reader, err error) {
+	header := make([]byte, HeaderSize)
+	_, err = io.ReadFull(rd, header)
+	if err != nil {
+		err = fmt.Errorf("Failed to read stream header: %s", err.Error())
+		return
+	}
+	if !bytes.Equal(header[:len(magic)], []byte(magic)) {
+		err = fmt.Errorf("Not a btrfs send stream")
+		return
+	}
+	version := binary.LittleEndian.Uint32(header[len(magic):])
+	if version < 1 || version > MaxVersion {
+		err = fmt.Errorf("Unsupported send stream version %d", version)
+		return
+	}
+	r = &Reader{
+		rd:        rd,
+		Version:   version,
+		offset:    int64(HeaderSize),
+		cmdHeader: make([]byte, CommandHeaderSize)}
+	return
+}
+
+// Offset returns the number of bytes of the stream read so far
+func (r *Reader) Offset() int64 {
+	return r.offset
+}
+
+// Next returns the next command of the stream after checking its checksum.
+// The end command is returned like any other. After it Next returns io.EOF,
+// or an error if there is data after the end command. The attribute values
+// are only valid until the next call
+func (r *Reader) Next() (cmd Command, err error) {
+	if r.done {
+		var n int64
+		n, err = io.Copy(ioutil.Discard, r.rd)
+		if err == nil && n > 0 {
+			err = fmt.Errorf("%d bytes of trailing data after the end command", n)
+		}
+		if err == nil {
+			err = io.EOF
+		}
+		return
+	}
+	_, err = io.ReadFull(r.rd, r.cmdHeader)
+	if err == io.EOF {
+		err = fmt.Errorf("Stream ended without an end command after %d commands", r.commands)
+		return
+	} else if err != nil {
+		err = fmt.Errorf("Truncated command %d: %s", r.commands+1, err.Error())
+		return
+	}
+	length := binary.LittleEndian.Uint32(r.cmdHeader[0:4])
+	cmd.Type = CommandType(binary.LittleEndian.Uint16(r.cmdHeader[4:6]))
+	crc := binary.LittleEndian.Uint32(r.cmdHeader[6:10])
+	// The length is checked before anything is allocated for the payload
+	if length > maxCommandSize(r.Version)-uint32(CommandHeaderSize) {
+		err = fmt.Errorf("Command %d (%s) at offset %d is too long (%d bytes)", r.commands+1, cmd.Type, r.offset, length)
+		return
+	}
+	if uint32(cap(r.payload)) < length {
+		r.payload = make([]byte, length)
+	}
+	r.payload = r.payload[:length]
+	_, err = io.ReadFull(r.rd, r.payload)
+	if err != nil {
+		err = fmt.Errorf("Truncated command %d: %s", r.commands+1, err.Error())
+		return
+	}
+	r.commands++
+	cmd.Offset = r.offset
+	cmd.Size = int64(CommandHeaderSize) + int64(length)
+	r.offset += cmd.Size
+	// The checksum is calculated with the crc field set to zero
+	binary.LittleEndian.PutUint32(r.cmdHeader[6:10], 0)
+	if CRC(r.cmdHeader, r.payload) != crc {
+		err = fmt.Errorf("Checksum mismatch in command %d (%s) at offset %d", r.commands, cmd.Type, cmd.Offset)
+		return
+	}
+	cmd.Attrs, err = parseAttrs(r.Version, r.payload)
+	if err != nil {
+		err = fmt.Errorf("Invalid command %d (%s): %s", r.commands, cmd.Type, err.Error())
+		return
+	}
+	if cmd.Type == CmdEnd {
+		r.done = true
+	}
+	return
+}
+
+// ReadAll reads the whole stream, calling fn with every command before the
+// end command. fn may be nil to only check the stream
+func ReadAll(rd io.Reader, fn func(cmd Command) error) (version uint32, err error) {
+	r, err := NewReader(rd)
+	if err != nil {
+		return
+	}
+	version = r.Version
+	for {
+		var cmd Command
+		cmd, err = r.Next()
+		if err == io.EOF {
+			return version, nil
+		} else if err != nil {
+			return
+		}
+		if cmd.Type != CmdEnd && fn != nil {
+			err = fn(cmd)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package sendstream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testAttr struct {
+	typ  Attribute
+	data []byte
+}
+
+func pathAttr(p string) testAttr {
+	return testAttr{AttrPath, []byte(p)}
+}
+
+func uint64Attr(typ Attribute, value uint64) testAttr {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, value)
+	return testAttr{typ, data}
+}
+
+// streamHeader returns the header of a stream of the given version
+func streamHeader(version uint32) []byte {
+	header := make([]byte, HeaderSize)
+	copy(header, magic)
+	binary.LittleEndian.PutUint32(header[len(magic):], version)
+	return header
+}
+
+// rawCommand returns a command with the given payload and a valid checksum
+func rawCommand(typ CommandType, payload []byte) []byte {
+	cmd := make([]byte, CommandHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(cmd[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint16(cmd[4:6], uint16(typ))
+	copy(cmd[CommandHeaderSize:], payload)
+	binary.LittleEndian.PutUint32(cmd[6:10], CRC(cmd))
+	return cmd
+}
+
+// encodeCommand encodes a command the way the kernel does for a stream of
+// the given version
+func encodeCommand(version uint32, typ CommandType, attrs ...testAttr) []byte {
+	var payload bytes.Buffer
+	for _, attr := range attrs {
+		binary.Write(&payload, binary.LittleEndian, uint16(attr.typ))
+		if version < 2 || attr.typ != AttrData {
+			binary.Write(&payload, binary.LittleEndian, uint16(len(attr.data)))
+		}
+		payload.Write(attr.data)
+	}
+	return rawCommand(typ, payload.Bytes())
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// refCRC is a bitwise crc32c with a seed of 0 and no final inversion
+func refCRC(data []byte) uint32 {
+	crc := uint32(0)
+	for _, b := range data {
+		crc ^= uint32(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0x82f63b78
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+func TestCRC(t *testing.T) {
+	if got := CRC([]byte("123456789")); got != 0x58e3fa20 {
+		t.Errorf("CRC(123456789) = %#x, want 0x58e3fa20", got)
+	}
+	data := []byte("btrfs-stream\x00\x01\x00\x00\x00 some more data")
+	for i := 0; i <= len(data); i++ {
+		if got, want := CRC(data[:i], data[i:]), refCRC(data); got != want {
+			t.Errorf("CRC split at %d = %#x, want %#x", i, got, want)
+		}
+	}
+}
+
+var uuid = bytes.Repeat([]byte{0xab}, 16)
+
+// v1Stream is a small version 1 stream creating a file in a new subvolume
+var v1Stream = join(
+	streamHeader(1),
+	encodeCommand(1, CmdSubvol, pathAttr("snap"), testAttr{AttrUUID, uuid}, uint64Attr(AttrCtransid, 7)),
+	encodeCommand(1, CmdMkfile, pathAttr("o257-7-0")),
+	encodeCommand(1, CmdRename, pathAttr("o257-7-0"), testAttr{AttrPathTo, []byte("file")}),
+	encodeCommand(1, CmdWrite, pathAttr("file"), uint64Attr(AttrFileOffset, 0), testAttr{AttrData, []byte("hello")}),
+	encodeCommand(1, CmdEnd),
+)
+
+// v2Stream is a version 2 stream, where the data attribute of a write has
+// no length and ends the command
+var v2Stream = join(
+	streamHeader(2),
+	encodeCommand(2, CmdSnapshot, pathAttr("snap"), testAttr{AttrUUID, uuid}, uint64Attr(AttrCtransid, 8), testAttr{AttrCloneUUID, uuid}, uint64Attr(AttrCloneCtransid, 7)),
+	encodeCommand(2, CmdWrite, pathAttr("file"), uint64Attr(AttrFileOffset, 5), testAttr{AttrData, []byte(" world")}),
+	encodeCommand(2, CmdFallocate, pathAttr("file"), uint64Attr(AttrFallocateMode, 1), uint64Attr(AttrFileOffset, 0), uint64Attr(AttrSize, 4096)),
+	encodeCommand(2, CmdEnd),
+)
+
+// corrupt returns a copy of stream with the byte at offset inverted
+func corrupt(stream []byte, offset int) []byte {
+	stream = append([]byte(nil), stream...)
+	stream[offset] ^= 0xff
+	return stream
+}
+
+// oversized returns a command header claiming a payload of
+// length bytes, without the payload
+func oversized(length uint32) []byte {
+	header := make([]byte, CommandHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:4], length)
+	binary.LittleEndian.PutUint16(header[4:6], uint16(CmdWrite))
+	return header
+}
+
+// attrHeader returns the header of a version 1 attribute
+func attrHeader(typ Attribute, length uint16) []byte {
+	header := make([]byte, 4)
+	binary.LittleEndian.PutUint16(header[0:2], uint16(typ))
+	binary.LittleEndian.PutUint16(header[2:4], length)
+	return header
+}
+
+func TestReadAll(t *testing.T) {
+	v1First := HeaderSize + CommandHeaderSize
+	tests := []struct {
+		name     string
+		stream   []byte
+		version  uint32
+		commands []CommandType
+		err      string
+	}{
+		{"v1", v1Stream, 1, []CommandType{CmdSubvol, CmdMkfile, CmdRename, CmdWrite}, ""},
+		{"v2", v2Stream, 2, []CommandType{CmdSnapshot, CmdWrite, CmdFallocate}, ""},
+		{"v3", join(streamHeader(3), encodeCommand(3, CmdEnableVerity, pathAttr("file")), encodeCommand(3, CmdEnd)), 3, []CommandType{CmdEnableVerity}, ""},
+		{"empty", nil, 0, nil, "Failed to read stream header"},
+		{"truncated header", v1Stream[:HeaderSize-4], 0, nil, "Failed to read stream header"},
+		{"bad magic", corrupt(v1Stream, 0), 0, nil, "Not a btrfs send stream"},
+		{"version 0", join(streamHeader(0), encodeCommand(1, CmdEnd)), 0, nil, "Unsupported send stream version 0"},
+		{"version 4", join(streamHeader(4), encodeCommand(1, CmdEnd)), 0, nil, "Unsupported send stream version 4"},
+		{"corrupted payload", corrupt(v1Stream, v1First+2), 1, nil, "Checksum mismatch in command 1"},
+		{"corrupted crc", corrupt(v1Stream, HeaderSize+6), 1, nil, "Checksum mismatch in command 1"},
+		{"corrupted type", corrupt(v1Stream, HeaderSize+4), 1, nil, "Checksum mismatch in command 1"},
+		{"truncated command header", v1Stream[:HeaderSize+4], 1, nil, "Truncated command 1"},
+		{"truncated command", v1Stream[:v1First+3], 1, nil, "Truncated command 1"},
+		{"truncated v2 data", v2Stream[:len(v2Stream)-CommandHeaderSize-1], 2, []CommandType{CmdSnapshot, CmdWrite}, "Truncated command 3"},
+		{"no end command", v1Stream[:len(v1Stream)-CommandHeaderSize], 1, []CommandType{CmdSubvol, CmdMkfile, CmdRename, CmdWrite}, "Stream ended without an end command after 4 commands"},
+		{"oversized command", join(streamHeader(1), oversized(64<<10)), 1, nil, "Command 1 (write) at offset 17 is too long (65536 bytes)"},
+		{"oversized v2 command", join(streamHeader(2), oversized(192<<10)), 2, nil, "is too long"},
+		{"oversized attribute", join(streamHeader(1), rawCommand(CmdMkfile, join(attrHeader(AttrPath, 100), []byte("abc"))), encodeCommand(1, CmdEnd)), 1, nil, "Invalid command 1 (mkfile): Attribute attribute 15 longer than its command"},
+		{"truncated attribute header", join(streamHeader(1), rawCommand(CmdMkfile, attrHeader(AttrPath, 0)[:3]), encodeCommand(1, CmdEnd)), 1, nil, "Invalid command 1 (mkfile): Truncated attribute header"},
+		{"trailing bytes", join(v1Stream, []byte("garbage")), 1, []CommandType{CmdSubvol, CmdMkfile, CmdRename, CmdWrite}, "7 bytes of trailing data after the end command"},
+	}
+	for _, test := range tests {
+		var commands []CommandType
+		version, err := ReadAll(bytes.NewReader(test.stream), func(cmd Command) error {
+			commands = append(commands, cmd.Type)
+			return nil
+		})
+		if test.err == "" && err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: error %v, want %q", test.name, err, test.err)
+		}
+		if version != test.version {
+			t.Errorf("%s: version %d, want %d", test.name, version, test.version)
+		}
+		if !reflect.DeepEqual(commands, test.commands) {
+			t.Errorf("%s: commands %v, want %v", test.name, commands, test.commands)
+		}
+	}
+}
+
+func TestReaderAttrs(t *testing.T) {
+	tests := []struct {
+		stream []byte
+		data   string
+		offset uint64
+	}{
+		{v1Stream, "hello", 0},
+		{v2Stream, " world", 5},
+	}
+	for _, test := range tests {
+		r, err := NewReader(bytes.NewReader(test.stream))
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset := int64(HeaderSize)
+		for {
+			cmd, err := r.Next()
+			if err != nil {
+				t.Fatalf("v%d: %s", r.Version, err)
+			}
+			if cmd.Offset != offset {
+				t.Errorf("v%d: %s at offset %d, want %d", r.Version, cmd.Type, cmd.Offset, offset)
+			}
+			offset += cmd.Size
+			if cmd.Type == CmdSubvol || cmd.Type == CmdSnapshot {
+				if cmd.Path() != "snap" || !bytes.Equal(cmd.Attrs[AttrUUID], uuid) {
+					t.Errorf("v%d: %s of %q uuid %x", r.Version, cmd.Type, cmd.Path(), cmd.Attrs[AttrUUID])
+				}
+			}
+			if cmd.Type == CmdWrite {
+				fileOffset, ok := cmd.Uint64(AttrFileOffset)
+				if cmd.Path() != "file" || cmd.String(AttrData) != test.data || !ok || fileOffset != test.offset {
+					t.Errorf("v%d: write of %q to %q at %d, want %q to file at %d", r.Version, cmd.String(AttrData), cmd.Path(), fileOffset, test.data, test.offset)
+				}
+			}
+			if cmd.Type == CmdEnd {
+				break
+			}
+		}
+		if r.Offset() != int64(len(test.stream)) {
+			t.Errorf("v%d: read %d bytes, want %d", r.Version, r.Offset(), len(test.stream))
+		}
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	summary, err := Summarize(bytes.NewReader(v1Stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Summary{
+		Version:    1,
+		Commands:   5,
+		Bytes:      int64(len(v1Stream)),
+		Counts:     map[string]int{"subvol": 1, "mkfile": 1, "rename": 1, "write": 1, "end": 1},
+		Paths:      3,
+		WriteBytes: 5,
+	}
+	if !reflect.DeepEqual(summary, want) {
+		t.Errorf("Summarize = %+v, want %+v", summary, want)
+	}
+}
@@ -0,0 +1,61 @@
+package sendstream
+
+import "io"
+
+// Summary describes a send stream that was read completely
+type Summary struct {
+	Version  uint32
+	Commands int
+	Bytes    int64
+	// Counts holds the number of commands of each type by name
+	Counts map[string]int
+	// Paths is the number of distinct paths the commands apply to
+	Paths int
+	// WriteBytes is the amount of file data in write commands
+	WriteBytes int64
+	// ExtentBytes is the amount of file data described by the update extent
+	// commands of a stream sent without data
+	ExtentBytes int64
+	// CloneBytes is the amount of file data shared with other files
+	CloneBytes int64
+}
+
+// Summarize reads the whole stream from rd, checking it like ReadAll, and
+// returns a summary of its commands
+func Summarize(rd io.Reader) (summary Summary, err error) {
+	r, err := NewReader(rd)
+	if err != nil {
+		return
+	}
+	summary.Version = r.Version
+	summary.Counts = make(map[string]int)
+	paths := make(map[string]bool)
+	for {
+		var cmd Command
+		cmd, err = r.Next()
+		if err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			return
+		}
+		summary.Commands++
+		summary.Counts[cmd.Type.String()]++
+		if p, ok := cmd.Attrs[AttrPath]; ok {
+			paths[string(p)] = true
+		}
+		switch cmd.Type {
+		case CmdWrite, CmdEncodedWrite:
+			summary.WriteBytes += int64(len(cmd.Attrs[AttrData]))
+		case CmdUpdateExtent:
+			size, _ := cmd.Uint64(AttrSize)
+			summary.ExtentBytes += int64(size)
+		case CmdClone:
+			size, _ := cmd.Uint64(AttrCloneLen)
+			summary.CloneBytes += int64(size)
+		}
+	}
+	summary.Bytes = r.Offset()
+	summary.Paths = len(paths)
+	return
+}
@@ -0,0 +1,119 @@
+package sendstream
+
+import "fmt"
+
+// CommandType identifies a command of the send stream
+type CommandType uint16
+
+// Command types as defined in fs/btrfs/send.h
+const (
+	CmdUnspec       CommandType = 0
+	CmdSubvol       CommandType = 1
+	CmdSnapshot     CommandType = 2
+	CmdMkfile       CommandType = 3
+	CmdMkdir        CommandType = 4
+	CmdMknod        CommandType = 5
+	CmdMkfifo       CommandType = 6
+	CmdMksock       CommandType = 7
+	CmdSymlink      CommandType = 8
+	CmdRename       CommandType = 9
+	CmdLink         CommandType = 10
+	CmdUnlink       CommandType = 11
+	CmdRmdir        CommandType = 12
+	CmdSetXattr     CommandType = 13
+	CmdRemoveXattr  CommandType = 14
+	CmdWrite        CommandType = 15
+	CmdClone        CommandType = 16
+	CmdTruncate     CommandType = 17
+	CmdChmod        CommandType = 18
+	CmdChown        CommandType = 19
+	CmdUtimes       CommandType = 20
+	CmdEnd          CommandType = 21
+	CmdUpdateExtent CommandType = 22
+	// Version 2
+	CmdFallocate    CommandType = 23
+	CmdFileattr     CommandType = 24
+	CmdEncodedWrite CommandType = 25
+	// Version 3
+	CmdEnableVerity CommandType = 26
+)
+
+var commandNames = map[CommandType]string{
+	CmdUnspec:       "unspec",
+	CmdSubvol:       "subvol",
+	CmdSnapshot:     "snapshot",
+	CmdMkfile:       "mkfile",
+	CmdMkdir:        "mkdir",
+	CmdMknod:        "mknod",
+	CmdMkfifo:       "mkfifo",
+	CmdMksock:       "mksock",
+	CmdSymlink:      "symlink",
+	CmdRename:       "rename",
+	CmdLink:         "link",
+	CmdUnlink:       "unlink",
+	CmdRmdir:        "rmdir",
+	CmdSetXattr:     "set_xattr",
+	CmdRemoveXattr:  "remove_xattr",
+	CmdWrite:        "write",
+	CmdClone:        "clone",
+	CmdTruncate:     "truncate",
+	CmdChmod:        "chmod",
+	CmdChown:        "chown",
+	CmdUtimes:       "utimes",
+	CmdEnd:          "end",
+	CmdUpdateExtent: "update_extent",
+	CmdFallocate:    "fallocate",
+	CmdFileattr:     "fileattr",
+	CmdEncodedWrite: "encoded_write",
+	CmdEnableVerity: "enable_verity",
+}
+
+func (t CommandType) String() string {
+	if name, ok := commandNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("command %d", uint16(t))
+}
+
+// Attribute identifies an attribute of a command
+type Attribute uint16
+
+// Attribute types as defined in fs/btrfs/send.h
+const (
+	AttrUUID          Attribute = 1
+	AttrCtransid      Attribute = 2
+	AttrIno           Attribute = 3
+	AttrSize          Attribute = 4
+	AttrMode          Attribute = 5
+	AttrUID           Attribute = 6
+	AttrGID           Attribute = 7
+	AttrRdev          Attribute = 8
+	AttrCtime         Attribute = 9
+	AttrMtime         Attribute = 10
+	AttrAtime         Attribute = 11
+	AttrOtime         Attribute = 12
+	AttrXattrName     Attribute = 13
+	AttrXattrData     Attribute = 14
+	AttrPath          Attribute = 15
+	AttrPathTo        Attribute = 16
+	AttrPathLink      Attribute = 17
+	AttrFileOffset    Attribute = 18
+	AttrData          Attribute = 19
+	AttrCloneUUID     Attribute = 20
+	AttrCloneCtransid Attribute = 21
+	AttrClonePath     Attribute = 22
+	AttrCloneOffset   Attribute = 23
+	AttrCloneLen      Attribute = 24
+	// Version 2
+	AttrFallocateMode    Attribute = 25
+	AttrFileattr         Attribute = 26
+	AttrUnencodedFileLen Attribute = 27
+	AttrUnencodedLen     Attribute = 28
+	AttrUnencodedOffset  Attribute = 29
+	AttrCompression      Attribute = 30
+	AttrEncryption       Attribute = 31
+)
+
+func (a Attribute) String() string {
+	return fmt.Sprintf("attribute %d", uint16(a))
+}
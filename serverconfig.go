@@ -0,0 +1,251 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const defaultTLSPort string = "7878"
+
+const defaultServerConfigFile string = "/etc/incrbtrfs/server.cfg"
+
+var serverConfigFlag = flag.String("serverConfig", defaultServerConfigFile, "Server config file with the retention policy for -rpc and -receive")
+
+type ServerDestination struct {
+	Directory string
+	Clients   []string
+	Limits    OptionalLimits
+	MinLimits OptionalLimits `toml:"min_limits"`
+	MaxLimits OptionalLimits `toml:"max_limits"`
+	Pin       bool
+	// MaxPinAge is how long after it was taken a snapshot may be kept by the
+	// pins of clients without shell access on the server
+	MaxPinAge string `toml:"max_pin_age"`
+	maxPinAge time.Duration
+	// Forward lists the remotes that snapshots received into the
+	// destination are sent on to
+	Forward []RemoteConfig
+}
+
+type ServerConfig struct {
+	Listen      string
+	Cert        string
+	Key         string
+	ClientCA    string `toml:"client_ca"`
+	Destination []ServerDestination
+}
+
+func parseServerFile(configFile string) (config ServerConfig, err error) {
+	_, err = toml.DecodeFile(configFile, &config)
+	if err != nil {
+		return
+	}
+	if config.Listen == "" {
+		config.Listen = ":" + defaultTLSPort
+	}
+	for i, destination := range config.Destination {
+		if destination.Directory == "" {
+			err = fmt.Errorf("No directory specified for destination %d", i+1)
+			return
+		}
+		// Requests are compared against destinations after resolving their
+		// symlinks, so the destinations have to be resolved as well
+		config.Destination[i].Directory, err = resolvePath(destination.Directory)
+		if err != nil {
+			return
+		}
+		if destination.MaxPinAge != "" {
+			config.Destination[i].maxPinAge, err = time.ParseDuration(destination.MaxPinAge)
+			if err != nil {
+				err = fmt.Errorf("Invalid max_pin_age for destination '%s': %s", destination.Directory, err.Error())
+				return
+			}
+		}
+		// Forward remotes are only parsed when forwarding. This catches
+		// mistakes when the config is loaded instead
+		config.Destination[i].Forwards(SnapshotsLoc{Directory: config.Destination[i].Directory})
+	}
+	return
+}
+
+// isSubdir reports whether dir is equal to or inside parent. Both are
+// expected to be absolute paths
+func isSubdir(parent string, dir string) bool {
+	parent = path.Clean(parent)
+	dir = path.Clean(dir)
+	if parent == dir || parent == "/" {
+		return true
+	}
+	return strings.HasPrefix(dir, parent+"/")
+}
+
+// reservedDirs are the directories a snapshot location keeps its own data
+// in. A destination inside one of them could be inside a received snapshot
+var reservedDirs = map[string]bool{"timestamp": true, "partial": true, "pinned": true}
+
+// resolvePath returns dir with all symlinks resolved. Trailing components
+// that don't exist yet are kept as they are
+func resolvePath(dir string) (resolved string, err error) {
+	dir = path.Clean(dir)
+	rest := ""
+	for {
+		resolved, err = filepath.EvalSymlinks(dir)
+		if err == nil {
+			resolved = path.Join(resolved, rest)
+			return
+		}
+		if !os.IsNotExist(err) || dir == "/" {
+			return
+		}
+		rest = path.Join(path.Base(dir), rest)
+		dir = path.Dir(dir)
+	}
+}
+
+// Allows reports whether any of the client names may use the destination
+func (destination ServerDestination) Allows(client []string) bool {
+	for _, allowed := range destination.Clients {
+		// Any client includes one without a name
+		if allowed == "*" {
+			return true
+		}
+		for _, name := range client {
+			if allowed == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Authorize checks that client is allowed to use the destination directory
+// dir and returns it with symlinks resolved. Requests have to use the
+// resolved directory, as a symlink in a snapshot received from a client
+// could otherwise lead outside of the allowed directories. The destination
+// returned is the one whose policy applies to dir, which is the most specific
+// one containing it even if a broader one authorized the client
+func (config ServerConfig) Authorize(client []string, dir string) (resolved string, destination ServerDestination, err error) {
+	if !path.IsAbs(dir) {
+		err = fmt.Errorf("Destination '%s' is not an absolute path", dir)
+		return
+	}
+	resolved, err = resolvePath(dir)
+	if err != nil {
+		return
+	}
+	authorized := false
+	for _, candidate := range config.Destination {
+		if !isSubdir(candidate.Directory, resolved) {
+			continue
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(resolved, candidate.Directory), "/")
+		for _, component := range strings.Split(rel, "/") {
+			if reservedDirs[component] {
+				err = fmt.Errorf("Destination '%s' is inside a snapshot directory", dir)
+				return
+			}
+		}
+		authorized = authorized || candidate.Allows(client)
+	}
+	if !authorized {
+		err = fmt.Errorf("Client %v is not authorized for destination '%s'", client, dir)
+		return
+	}
+	destination, _ = config.FindDestination(resolved)
+	return
+}
+
+// Policy returns the limits to apply when receiving into the destination.
+// The limits requested by the client are raised to min_limits, lowered to
+// max_limits and then overridden by limits
+func (destination ServerDestination) Policy(limits Limits) Limits {
+	return limits.Raise(destination.MinLimits).Clamp(destination.MaxLimits).Merge(destination.Limits)
+}
+
+// ApplyPolicy adjusts the limits and pinning of a request to the policy of
+// the destination. Pins are never removed by clients of a destination with a
+// policy
+func (destination ServerDestination) ApplyPolicy(request *Request) {
+	request.Limits = destination.Policy(request.Limits)
+	request.Pin = request.Pin || destination.Pin
+	request.Unpin = false
+}
+
+// ApplyRestrictedPolicy applies the policy of the destination to a request
+// of a client without shell access on the server, which uses the restricted
+// receiver or the receive daemon. Only the destination decides whether
+// received snapshots are pinned, and pins replicated by the client are
+// limited by LimitPins
+func (destination ServerDestination) ApplyRestrictedPolicy(request *Request, now time.Time) {
+	destination.ApplyPolicy(request)
+	request.Pin = destination.Pin
+	request.Pins = destination.LimitPins(request.Pins, now)
+}
+
+// LimitPins returns the pins a client without shell access may replicate
+// into the destination. Without max_pin_age there are none. Otherwise each
+// pin expires max_pin_age after its snapshot was taken at the latest, so the
+// client can't keep snapshots any longer than that
+func (destination ServerDestination) LimitPins(pins []Pin, now time.Time) (limited []Pin) {
+	if destination.maxPinAge <= 0 {
+		return
+	}
+	for _, pin := range pins {
+		t, err := parseTimestamp(pin.Timestamp)
+		if err != nil {
+			continue
+		}
+		latest := t.Add(destination.maxPinAge)
+		if !latest.After(now) {
+			continue
+		}
+		expires, err := parseTimestamp(pin.Expires)
+		if pin.Expires == "" || err != nil || expires.After(latest) {
+			pin.Expires = Timestamp(latest.Format(timeFormat))
+		}
+		limited = append(limited, pin)
+	}
+	return
+}
+
+// ApplyPolicy applies the policy of the most specific destination containing
+// the directory of the request. This is independent of the destination that
+// authorized the client, so a broader destination never overrides the policy
+// of one nested in it
+func (config ServerConfig) ApplyPolicy(request *Request) {
+	if destination, ok := config.FindDestination(request.Destination); ok {
+		destination.ApplyPolicy(request)
+	}
+}
+
+// FindDestination returns the most specific destination containing dir,
+// regardless of the clients allowed to use it. dir is resolved the same way
+// as the directories of the destinations
+func (config ServerConfig) FindDestination(dir string) (destination ServerDestination, ok bool) {
+	if resolved, err := resolvePath(dir); err == nil {
+		dir = resolved
+	}
+	for _, candidate := range config.Destination {
+		if isSubdir(candidate.Directory, dir) && (!ok || len(candidate.Directory) > len(destination.Directory)) {
+			destination = candidate
+			ok = true
+		}
+	}
+	return
+}
+
+// loadServerPolicy reads the server config file given by -serverConfig for
+// its retention policy. A missing default file means there is no policy
+func loadServerPolicy() (config ServerConfig, err error) {
+	config, err = parseServerFile(*serverConfigFlag)
+	if os.IsNotExist(err) && !isFlagSet("serverConfig") {
+		return ServerConfig{}, nil
+	}
+	return
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+// writeServerConfig writes config to a file in dir and parses it
+func writeServerConfig(t *testing.T, dir string, config string) ServerConfig {
+	configFile := path.Join(dir, "server.cfg")
+	err := ioutil.WriteFile(configFile, []byte(config), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig, err := parseServerFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serverConfig
+}
+
+// makeDirs creates each of the directories in dir
+func makeDirs(t *testing.T, dir string, dirs ...string) {
+	for _, d := range dirs {
+		err := os.MkdirAll(path.Join(dir, d), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// makeLinks creates symlinks in dir. links maps the name of each link to
+// its target
+func makeLinks(t *testing.T, dir string, links map[string]string) {
+	for name, target := range links {
+		err := os.Symlink(target, path.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	dir := t.TempDir()
+	makeDirs(t, dir, "backups/host1", "outside")
+	makeLinks(t, dir, map[string]string{
+		"link":                 "backups",
+		"backups/host1/escape": "../../outside",
+	})
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"backups/host1", "backups/host1"},
+		{"backups/host1/", "backups/host1"},
+		{"link/host1", "backups/host1"},
+		{"link/host1/new/dirs", "backups/host1/new/dirs"},
+		{"backups/../outside", "outside"},
+		{"backups/host1/escape", "outside"},
+		{"backups/host1/escape/new", "outside/new"},
+		{"missing/../backups", "backups"},
+	}
+	for _, test := range tests {
+		got, err := resolvePath(path.Join(dir, test.in))
+		if err != nil {
+			t.Errorf("resolvePath(%q): %s", test.in, err)
+			continue
+		}
+		if got != path.Join(dir, test.want) {
+			t.Errorf("resolvePath(%q) = %q, want %q", test.in, got, path.Join(dir, test.want))
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	dir := t.TempDir()
+	makeDirs(t, dir, "backups/host1/timestamp/20160101", "open", "outside")
+	makeLinks(t, dir, map[string]string{
+		"link":                 "backups",
+		"backups/host1/escape": "../../outside",
+		"backups/host1/snap":   "timestamp/20160101",
+	})
+	config := writeServerConfig(t, dir, `
+[[destination]]
+directory = "`+dir+`/backups"
+clients = ["alice", "bob"]
+
+[[destination]]
+directory = "`+dir+`/backups/host1"
+clients = ["bob"]
+[destination.max_limits]
+daily = 5
+
+[[destination]]
+directory = "`+dir+`/link/host2"
+clients = ["carol"]
+
+[[destination]]
+directory = "`+dir+`/open"
+clients = ["*"]
+`)
+	tests := []struct {
+		names       []string
+		dir         string
+		resolved    string
+		destination string
+	}{
+		{[]string{"alice"}, "backups", "backups", "backups"},
+		{[]string{"alice"}, "backups/host1", "backups/host1", "backups/host1"},
+		{[]string{"bob"}, "backups/host1", "backups/host1", "backups/host1"},
+		{[]string{"alice"}, "link/host1/new", "backups/host1/new", "backups/host1"},
+		{[]string{"carol"}, "backups/host2", "backups/host2", "backups/host2"},
+		{[]string{"carol"}, "link/host2", "backups/host2", "backups/host2"},
+		{[]string{"dave", "alice"}, "backups/host3", "backups/host3", "backups"},
+		{[]string{"dave"}, "open/host1", "open/host1", "open"},
+		{[]string{"alice"}, "backups/host1/timestamps", "backups/host1/timestamps", "backups/host1"},
+		// Rejected
+		{[]string{"dave"}, "backups", "", ""},
+		{[]string{"carol"}, "backups/host1", "", ""},
+		{[]string{"alice"}, "outside", "", ""},
+		{[]string{"alice"}, "backups/../outside", "", ""},
+		{[]string{"alice"}, "backups/host1/escape", "", ""},
+		{[]string{"alice"}, "backups/host1/escape/new", "", ""},
+		{[]string{"alice"}, "backups/host1/timestamp", "", ""},
+		{[]string{"alice"}, "backups/host1/timestamp/20160101", "", ""},
+		{[]string{"alice"}, "backups/host1/snap", "", ""},
+		{[]string{"alice"}, "backups/host1/partial/new", "", ""},
+		{[]string{"alice"}, "backups/pinned", "", ""},
+		{[]string{"dave"}, "open/timestamp", "", ""},
+	}
+	for _, test := range tests {
+		resolved, destination, err := config.Authorize(test.names, path.Join(dir, test.dir))
+		if test.resolved == "" {
+			if err == nil {
+				t.Errorf("Authorize(%q, %q) = %q, want error", test.names, test.dir, resolved)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Authorize(%q, %q): %s", test.names, test.dir, err)
+			continue
+		}
+		if resolved != path.Join(dir, test.resolved) || destination.Directory != path.Join(dir, test.destination) {
+			t.Errorf("Authorize(%q, %q) = %q in %q, want %q in %q", test.names, test.dir, resolved, destination.Directory, path.Join(dir, test.resolved), path.Join(dir, test.destination))
+		}
+	}
+
+	_, _, err := config.Authorize([]string{"alice"}, "backups")
+	if err == nil {
+		t.Errorf("Authorize of a relative path succeeded")
+	}
+}
+
+func TestApplyPolicySymlinkedDestination(t *testing.T) {
+	dir := t.TempDir()
+	makeDirs(t, dir, "target")
+	makeLinks(t, dir, map[string]string{"link": "target"})
+	target := path.Join(dir, "target")
+	link := path.Join(dir, "link")
+	config := writeServerConfig(t, dir, `
+[[destination]]
+directory = "`+link+`"
+clients = ["alice"]
+pin = true
+[destination.min_limits]
+daily = 10
+`)
+
+	// Restricted receivers and the TLS daemon apply the policy of the
+	// destination returned by Authorize
+	resolved, destination, err := config.Authorize([]string{"alice"}, path.Join(link, "host"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := Request{Destination: resolved}
+	destination.ApplyPolicy(&request)
+	if request.Limits.Daily != 10 || !request.Pin {
+		t.Errorf("Policy through '%s' gave limits %v pin %v, want daily 10 and pin", resolved, request.Limits, request.Pin)
+	}
+	request = Request{Destination: resolved}
+	config.ApplyPolicy(&request)
+	if request.Limits.Daily != 10 || !request.Pin {
+		t.Errorf("Policy of '%s' gave limits %v pin %v, want daily 10 and pin", resolved, request.Limits, request.Pin)
+	}
+
+	// Plain receivers look up the destination they were given
+	for _, dir := range []string{link, path.Join(link, "host"), target, path.Join(target, "host")} {
+		destination, ok := config.FindDestination(dir)
+		if !ok || destination.Directory != target {
+			t.Errorf("FindDestination(%q) = %q %v, want %q", dir, destination.Directory, ok, target)
+		}
+	}
+}
+
+func TestAuthorizeWithoutClientName(t *testing.T) {
+	dir := t.TempDir()
+	config := ServerConfig{Destination: []ServerDestination{
+		{Directory: path.Join(dir, "any"), Clients: []string{"*"}},
+		{Directory: path.Join(dir, "named"), Clients: []string{"alice"}},
+	}}
+	tests := []struct {
+		names []string
+		dir   string
+		ok    bool
+	}{
+		{[]string{}, path.Join(dir, "any"), true},
+		{nil, path.Join(dir, "any", "host"), true},
+		{[]string{"bob"}, path.Join(dir, "any"), true},
+		{[]string{}, path.Join(dir, "named"), false},
+		{[]string{"alice"}, path.Join(dir, "named"), true},
+	}
+	for _, test := range tests {
+		_, _, err := config.Authorize(test.names, test.dir)
+		if (err == nil) != test.ok {
+			t.Errorf("Authorize(%q, %q) error = %v, want ok %v", test.names, test.dir, err, test.ok)
+		}
+	}
+}
+
+func TestLimitPins(t *testing.T) {
+	now, _ := parseTimestamp("20160201_000000")
+	pins := []Pin{
+		{Name: "forever", Timestamp: "20160120_000000"},
+		{Name: "soon", Timestamp: "20160120_000000", Expires: "20160202_000000"},
+		{Name: "later", Timestamp: "20160120_000000", Expires: "20170101_000000"},
+		{Name: "old", Timestamp: "20151201_000000"},
+		{Name: "invalid", Timestamp: "latest"},
+	}
+	tests := []struct {
+		maxPinAge string
+		want      []Pin
+	}{
+		{"", nil},
+		{"720h", []Pin{
+			{Name: "forever", Timestamp: "20160120_000000", Expires: "20160219_000000"},
+			{Name: "soon", Timestamp: "20160120_000000", Expires: "20160202_000000"},
+			{Name: "later", Timestamp: "20160120_000000", Expires: "20160219_000000"},
+		}},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		config := writeServerConfig(t, dir, `
+[[destination]]
+directory = "`+dir+`"
+clients = ["*"]
+max_pin_age = "`+test.maxPinAge+`"
+`)
+		got := config.Destination[0].LimitPins(pins, now)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("max_pin_age %q kept %v, want %v", test.maxPinAge, got, test.want)
+		}
+	}
+
+	dir := t.TempDir()
+	configFile := path.Join(dir, "server.cfg")
+	err := ioutil.WriteFile(configFile, []byte(`
+[[destination]]
+directory = "`+dir+`"
+max_pin_age = "30d"
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = parseServerFile(configFile)
+	if err == nil {
+		t.Errorf("Invalid max_pin_age accepted")
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseSize parses a byte count with an optional K, M, G or T suffix, which
+// are powers of 1024
+func parseSize(s string) (size int64, err error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(str, "B")
+	multiplier := int64(1)
+	if n := len(str); n > 0 {
+		switch str[n-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier != 1 {
+			str = str[:n-1]
+		}
+	}
+	value, err := strconv.ParseFloat(str, 64)
+	if err != nil || value < 0 {
+		err = fmt.Errorf("Invalid size '%s'", s)
+		return
+	}
+	size = int64(value * float64(multiplier))
+	return
+}
+
+// formatSize formats a byte count using binary units
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	value := float64(size)
+	suffixes := "KMGTPE"
+	i := -1
+	for value >= unit && i < len(suffixes)-1 {
+		value /= unit
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, suffixes[i])
+}
@@ -17,7 +17,11 @@ func (s Snapshot) Path() string {
 
 // DeleteSnapshot tries to delete a btrfs snaphot. Returns an error if it fail
 func (s Snapshot) DeleteSnapshot() (err error) {
-	btrfsCmd := exec.Command(btrfsBin, "subvolume", "delete", s.Path())
+	return deleteSubvolume(s.Path())
+}
+
+func deleteSubvolume(subvolumePath string) (err error) {
+	btrfsCmd := exec.Command(btrfsBin, "subvolume", "delete", subvolumePath)
 	if verbosity > 1 {
 		printCommand(btrfsCmd)
 		btrfsCmd.Stdout = os.Stderr
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"github.com/golang/snappy"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path"
+	"sort"
 	"strconv"
 	"time"
 )
@@ -42,24 +44,8 @@ func (snapshotsLoc SnapshotsLoc) clean(interval Interval, now time.Time, timesta
 	if err != nil {
 		return
 	}
-	maxIndex := interval.GetMaxIndex(snapshotsLoc.Limits)
-	keptIndices := make(map[int]bool)
 	keptTimestampsMap = make(TimestampMap)
-	for _, timestamp := range timestamps {
-		var i int
-		var snapshotTime time.Time
-		snapshotTime, err = parseTimestamp(timestamp)
-		if err != nil {
-			continue
-		}
-		i = interval.CalcIndex(now, snapshotTime)
-		if i >= maxIndex {
-			continue
-		}
-		if _, ok := keptIndices[i]; ok {
-			continue
-		}
-		keptIndices[i] = true
+	for i, timestamp := range interval.Select(snapshotsLoc.Limits, now, timestamps) {
 		keptTimestampsMap[timestamp] = true
 		src := path.Join("..", "timestamp", string(timestamp))
 		dst := path.Join(dir, strconv.Itoa(i))
@@ -74,41 +60,31 @@ func (snapshotsLoc SnapshotsLoc) clean(interval Interval, now time.Time, timesta
 	return
 }
 
-func (snapshotsLoc SnapshotsLoc) markPinned() (keptTimestampsMap TimestampMap, err error) {
-	dir := path.Join(snapshotsLoc.Directory, "pinned")
-	err = os.MkdirAll(dir, dirMode)
-	if err != nil {
-		return
-	}
-	fileInfos, err := ioutil.ReadDir(dir)
+// markPinned returns the timestamps kept by pins. Expired pins are removed.
+// Symlinks in the pinned directory that can't be read as pins still keep
+// the snapshot they point to
+func (snapshotsLoc SnapshotsLoc) markPinned(now time.Time) (keptTimestampsMap TimestampMap, err error) {
+	pins, invalid, err := snapshotsLoc.readPinFiles()
 	if err != nil {
 		return
 	}
 	keptTimestampsMap = make(TimestampMap)
-	for _, fileInfo := range fileInfos {
-		if fileInfo.Mode()&os.ModeSymlink != 0 {
-			fullPath := path.Join(dir, fileInfo.Name())
-			// Check to see if symlink exists
-			_, err = os.Stat(fullPath)
-			if err != nil {
-				log.Println(err.Error())
-				err = nil
-				continue
+	for name, timestamp := range invalid {
+		log.Printf("Warning: '%s' in '%s' is not a valid pin. Keeping %s\n", name, snapshotsLoc.pinDir(), string(timestamp))
+		keptTimestampsMap[timestamp] = true
+	}
+	for _, pin := range pins {
+		if pin.Expired(now) {
+			if verbosity > 0 {
+				log.Printf("Pin '%s' of %s expired\n", pin.Name, string(pin.Timestamp))
 			}
-			// Right now it just follows the symlink and assumes the filename is a
-			// valid timestamp. It probably should make some effort to determine if
-			// the symlink goes to the timestamps directory
-			fileName, err := os.Readlink(fullPath)
+			_, err = snapshotsLoc.RemovePin(pin.Name)
 			if err != nil {
-				if verbosity > 0 {
-					log.Println(err.Error())
-					err = nil
-					continue
-				}
+				return
 			}
-			timestamp := Timestamp(path.Base(fileName))
-			keptTimestampsMap[timestamp] = true
+			continue
 		}
+		keptTimestampsMap[pin.Timestamp] = true
 	}
 	return
 }
@@ -131,11 +107,18 @@ func (snapshotsLoc SnapshotsLoc) CleanUp(nowTimestamp Timestamp, timestamps []Ti
 		}
 		keptTimestampsMap = keptTimestampsMap.Merge(tempMap)
 	}
-	pinnedTimestampsMap, err := snapshotsLoc.markPinned()
+	pinnedTimestampsMap, err := snapshotsLoc.markPinned(time.Now())
 	if err != nil {
 		return
 	}
 	keptTimestampsMap = keptTimestampsMap.Merge(pinnedTimestampsMap)
+	archiveParent, err := snapshotsLoc.ArchiveParent()
+	if err != nil {
+		return
+	}
+	if archiveParent != "" {
+		keptTimestampsMap[archiveParent] = true
+	}
 	// Remove unneeded timestamps
 	for _, timestamp := range timestamps {
 		if _, ok := keptTimestampsMap[timestamp]; ok {
@@ -259,16 +242,73 @@ func (snapshotsLoc SnapshotsLoc) ReceiveAndCleanUp(in io.Reader, timestamp Times
 	return
 }
 
-func (snapshotsLoc SnapshotsLoc) ReadTimestampsDir() (timestamps []Timestamp, err error) {
-	timestampsDir := path.Join(snapshotsLoc.Directory, "timestamp")
-	err = os.MkdirAll(timestampsDir, dirMode)
+// Receive receives a snapshot stream, optionally snappy compressed, and
+// cleans up old snapshots once it completes. If verify is not nil it is
+// called once the stream has been received and the new snapshot is deleted
+// again if it fails. The caller is expected to hold the lock on the
+// directory
+func (snapshotsLoc SnapshotsLoc) Receive(in io.Reader, timestamp Timestamp, compressed bool, verify func() error) (err error) {
+	if verbosity > 2 {
+		log.Println("Receive: ReceiveSnapshot")
+	}
+	if compressed {
+		in = snappy.NewReader(in)
+	}
+	runner := snapshotsLoc.ReceiveSnapshot(in, timestamp)
+	err = <-runner.Started
+	if verbosity > 2 {
+		log.Println("Receive: ReceiveSnapshot Started")
+	}
 	if err != nil {
 		return
 	}
-	fileInfos, err := ioutil.ReadDir(timestampsDir)
+	err = <-runner.Done
+	if verbosity > 2 {
+		log.Println("Receive: ReceiveSnapshot Done")
+	}
+	if err != nil {
+		return
+	}
+	if verify != nil {
+		err = verify()
+		if err != nil {
+			snapshot := Snapshot{snapshotsLoc, timestamp}
+			if errTmp := snapshot.DeleteSnapshot(); errTmp != nil {
+				log.Println(errTmp.Error())
+			}
+			return
+		}
+	}
+	timestamps, err := snapshotsLoc.ReadTimestampsDir()
 	if err != nil {
 		return
 	}
+	_, err = snapshotsLoc.CleanUp(timestamp, timestamps)
+	return
+}
+
+// Prune removes snapshots that are no longer covered by the limits, treating
+// the most recent snapshot as the current one. The caller is expected to
+// hold the lock on the directory
+func (snapshotsLoc SnapshotsLoc) Prune() (err error) {
+	timestamps, err := snapshotsLoc.ReadTimestampsDir()
+	if err != nil || len(timestamps) == 0 {
+		return
+	}
+	sort.Sort(Timestamps(timestamps))
+	_, err = snapshotsLoc.CleanUp(timestamps[len(timestamps)-1], timestamps)
+	return
+}
+
+func (snapshotsLoc SnapshotsLoc) ReadTimestampsDir() (timestamps []Timestamp, err error) {
+	timestampsDir := path.Join(snapshotsLoc.Directory, "timestamp")
+	fileInfos, err := ioutil.ReadDir(timestampsDir)
+	if os.IsNotExist(err) {
+		// Nothing has been snapshotted or received yet
+		return nil, nil
+	} else if err != nil {
+		return
+	}
 	for _, fi := range fileInfos {
 		if fi.IsDir() {
 			timestamp := Timestamp(fi.Name())
@@ -282,18 +322,3 @@ func (snapshotsLoc SnapshotsLoc) ReadTimestampsDir() (timestamps []Timestamp, er
 	err = nil
 	return
 }
-
-func (snapshotsLoc SnapshotsLoc) PinTimestamp(timestamp Timestamp) (err error) {
-	pinDir := path.Join(snapshotsLoc.Directory, "pinned")
-	err = os.MkdirAll(pinDir, dirMode)
-	if err != nil {
-		return
-	}
-	src := path.Join("..", "timestamp", string(timestamp))
-	dst := path.Join(pinDir, string(timestamp))
-	if verbosity > 1 {
-		log.Printf("Symlink '%s' => '%s'\n", dst, src)
-	}
-	err = os.Symlink(src, dst)
-	return
-}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+)
+
+// maxParts is the number of parts that fit in the three digit part numbers,
+// which keeps the parts in order when listed or matched by a shell glob
+const maxParts int = 1000
+
+// partName returns the name of part i of a split archive
+func partName(archiveFile string, i int) string {
+	return fmt.Sprintf("%s.%03d", archiveFile, i)
+}
+
+// trimPartSuffix strips the part number from the name of a part of a split
+// archive. ok is false if fileName isn't a part
+func trimPartSuffix(fileName string) (archiveFile string, part int, ok bool) {
+	ext := path.Ext(fileName)
+	if len(ext) != 4 {
+		return fileName, 0, false
+	}
+	part, err := strconv.Atoi(ext[1:])
+	if err != nil {
+		return fileName, 0, false
+	}
+	return fileName[:len(fileName)-len(ext)], part, true
+}
+
+// splitWriter writes to a series of files of at most size bytes each. The
+// parts are written under temporary names until Commit is called
+type splitWriter struct {
+	archiveFile string
+	size        int64
+	f           *os.File
+	written     int64
+	Parts       int
+}
+
+func newSplitWriter(archiveFile string, size int64) *splitWriter {
+	return &splitWriter{archiveFile: archiveFile, size: size}
+}
+
+func (w *splitWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		if w.f == nil || w.written == w.size {
+			err = w.next()
+			if err != nil {
+				return
+			}
+		}
+		chunk := p
+		if int64(len(chunk)) > w.size-w.written {
+			chunk = chunk[:w.size-w.written]
+		}
+		var m int
+		m, err = w.f.Write(chunk)
+		n += m
+		w.written += int64(m)
+		if err != nil {
+			return
+		}
+		p = p[m:]
+	}
+	return
+}
+
+func (w *splitWriter) next() (err error) {
+	if w.f != nil {
+		err = w.f.Close()
+		if err != nil {
+			return
+		}
+	}
+	if w.Parts == maxParts {
+		err = fmt.Errorf("Archive needs more than %d parts. Increase the split size", maxParts)
+		return
+	}
+	w.f, err = os.Create(partName(w.archiveFile, w.Parts) + tmpExtension)
+	if err != nil {
+		return
+	}
+	w.Parts++
+	w.written = 0
+	return
+}
+
+func (w *splitWriter) Close() (err error) {
+	if w.f == nil {
+		// An empty archive still has a first part
+		err = w.next()
+		if err != nil {
+			return
+		}
+	}
+	return w.f.Close()
+}
+
+// Commit renames the parts to their final names once they are complete
+func (w *splitWriter) Commit() (err error) {
+	for i := 0; i < w.Parts; i++ {
+		err = os.Rename(partName(w.archiveFile, i)+tmpExtension, partName(w.archiveFile, i))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// partReader reads the parts of a split archive in order, opening each
+// one when the previous one is exhausted
+type partReader struct {
+	archiveFile string
+	parts       int
+	next        int
+	f           *os.File
+}
+
+func (r *partReader) Read(p []byte) (n int, err error) {
+	for {
+		if r.f == nil {
+			if r.next == r.parts {
+				return 0, io.EOF
+			}
+			r.f, err = os.Open(partName(r.archiveFile, r.next))
+			if err != nil {
+				return
+			}
+			r.next++
+		}
+		n, err = r.f.Read(p)
+		if err != io.EOF {
+			return
+		}
+		r.f.Close()
+		r.f = nil
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *partReader) Close() error {
+	if r.f != nil {
+		return r.f.Close()
+	}
+	return nil
+}
+
+// countParts returns the number of consecutive parts of a split archive
+func countParts(archiveFile string) (parts int) {
+	for {
+		if _, err := os.Stat(partName(archiveFile, parts)); err != nil {
+			return
+		}
+		parts++
+	}
+}
+
+// archiveExists reports whether archiveFile exists as a single file or as
+// the first part of a split archive
+func archiveExists(archiveFile string) bool {
+	if _, err := os.Stat(archiveFile); err == nil {
+		return true
+	}
+	_, err := os.Stat(partName(archiveFile, 0))
+	return err == nil
+}
+
+// openArchive opens an archive file, joining the parts of a split archive
+// back together. The number of parts is taken from the manifest when it
+// records the archive, so that missing parts are detected
+func openArchive(archiveFile string) (rd io.ReadCloser, err error) {
+	f, err := os.Open(archiveFile)
+	if err == nil || !os.IsNotExist(err) {
+		return f, err
+	}
+	parts := countParts(archiveFile)
+	if parts == 0 {
+		return
+	}
+	err = nil
+	timestamp, _, errName := parseArchiveName(archiveFile)
+	if errName == nil {
+		manifest, errManifest := ReadManifest(path.Dir(archiveFile))
+		if entry, ok := manifest.Find(timestamp); errManifest == nil && ok && entry.Parts > 0 {
+			for i := 0; i < entry.Parts; i++ {
+				if _, err = os.Stat(partName(archiveFile, i)); err != nil {
+					err = fmt.Errorf("Missing part %s of %d", path.Base(partName(archiveFile, i)), entry.Parts)
+					return
+				}
+			}
+			parts = entry.Parts
+		}
+	}
+	rd = &partReader{archiveFile: archiveFile, parts: parts}
+	return
+}
+
+// removeArchiveFiles deletes an archive file or all of the parts of a split
+// archive
+func removeArchiveFiles(archiveFile string) (err error) {
+	err = os.Remove(archiveFile)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	err = nil
+	for i := 0; ; i++ {
+		err = os.Remove(partName(archiveFile, i))
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// shellQuote quotes s so that the remote shell started by ssh sees it as a
+// single word, regardless of spaces or shell metacharacters
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	safe := true
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_./=:,+@%", c)) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func (remote RemoteSnapshotsLoc) sshPath() string {
+	if remote.User != "" {
+		return remote.User + "@" + remote.Host
+	}
+	return remote.Host
+}
+
+// sshArgs builds the argument list for ssh which runs remote.Exec with args
+// on the remote host. Exec is passed through to the remote shell as is so
+// that it may contain a wrapper like sudo. Every other argument is quoted.
+func (remote RemoteSnapshotsLoc) sshArgs(args ...string) []string {
+	var sshArgs []string
+	if remote.Port != "" {
+		sshArgs = append(sshArgs, "-p", remote.Port)
+	}
+	if remote.Identity != "" {
+		sshArgs = append(sshArgs, "-i", remote.Identity)
+	}
+	for _, option := range remote.SSHOptions {
+		sshArgs = append(sshArgs, "-o", option)
+	}
+	remoteCmd := []string{remote.Exec}
+	for _, arg := range args {
+		remoteCmd = append(remoteCmd, shellQuote(arg))
+	}
+	sshArgs = append(sshArgs, "--", remote.sshPath(), strings.Join(remoteCmd, " "))
+	return sshArgs
+}
+
+// Command returns the ssh command which runs incrbtrfs on the remote host
+// with the given arguments
+func (remote RemoteSnapshotsLoc) Command(args ...string) *exec.Cmd {
+	return exec.Command("ssh", remote.sshArgs(args...)...)
+}
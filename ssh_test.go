@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os/exec"
+	"reflect"
+	"testing"
+)
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", "''"},
+		{"/home/.incrbtrfs", "/home/.incrbtrfs"},
+		{"-destination", "-destination"},
+		{"user@host:2222", "user@host:2222"},
+		{"/mnt/my backups", "'/mnt/my backups'"},
+		{"it's", `'it'\''s'`},
+		{"''", `''\'''\'''`},
+		{"$HOME", "'$HOME'"},
+		{"/tmp; rm -rf /", "'/tmp; rm -rf /'"},
+		{"`id`", "'`id`'"},
+		{"a\nb", "'a\nb'"},
+	}
+	for _, test := range tests {
+		got := shellQuote(test.in)
+		if got != test.want {
+			t.Errorf("shellQuote(%q) = %q, want %q", test.in, got, test.want)
+		}
+		out, err := exec.Command("sh", "-c", "printf '%s' "+got).Output()
+		if err != nil {
+			t.Fatalf("sh -c with %q: %s", got, err)
+		}
+		if string(out) != test.in {
+			t.Errorf("sh sees %q as %q, want %q", got, string(out), test.in)
+		}
+	}
+}
+
+func TestSSHArgs(t *testing.T) {
+	tests := []struct {
+		remote RemoteSnapshotsLoc
+		args   []string
+		want   []string
+	}{
+		{
+			RemoteSnapshotsLoc{Host: "backup", Exec: "incrbtrfs"},
+			[]string{"-rpc"},
+			[]string{"--", "backup", "incrbtrfs -rpc"},
+		},
+		{
+			RemoteSnapshotsLoc{Host: "backup", User: "root", Port: "2222", Identity: "/root/.ssh/id_backup", SSHOptions: []string{"Compression=no", "ServerAliveInterval=30"}, Exec: "sudo incrbtrfs"},
+			[]string{"-receive", "-check"},
+			[]string{"-p", "2222", "-i", "/root/.ssh/id_backup", "-o", "Compression=no", "-o", "ServerAliveInterval=30", "--", "root@backup", "sudo incrbtrfs -receive -check"},
+		},
+		{
+			RemoteSnapshotsLoc{Host: "-oProxyCommand=id", Exec: "incrbtrfs"},
+			[]string{"-rpc"},
+			[]string{"--", "-oProxyCommand=id", "incrbtrfs -rpc"},
+		},
+		{
+			RemoteSnapshotsLoc{Host: "backup", Exec: "incrbtrfs"},
+			[]string{"-receive", "-destination", "/mnt/my backups/it's $HOME; id"},
+			[]string{"--", "backup", `incrbtrfs -receive -destination '/mnt/my backups/it'\''s $HOME; id'`},
+		},
+	}
+	for _, test := range tests {
+		got := test.remote.sshArgs(test.args...)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("sshArgs(%q) = %q, want %q", test.args, got, test.want)
+		}
+	}
+}
@@ -1,19 +1,54 @@
 package main
 
 import (
-	"bufio"
-	"github.com/golang/snappy"
 	"log"
 	"os"
 	"os/exec"
 	"path"
 	"strings"
+	"time"
 )
 
+// ArchiveConfig holds the archive settings of a subvolume
+type ArchiveConfig struct {
+	Enabled bool
+	// Interval limits archiving to once per interval. Empty archives on
+	// every run
+	Interval  Interval
+	Directory string
+	// CreateDirectory is set for the default archive directory. A
+	// configured directory must already exist
+	CreateDirectory bool
+	// MinFree is the space in bytes to leave free in the archive directory
+	MinFree int64
+	Codec   string
+	// KeyFile enables encryption of archives with the key it holds
+	KeyFile     string
+	Incremental bool
+	FullEvery   int
+	// Limits is nil when archives are kept indefinitely
+	Limits *Limits
+	// SplitSize is the maximum size of an archive file. 0 disables
+	// splitting
+	SplitSize int64
+}
+
 type Subvolume struct {
-	Directory    string
-	SnapshotsLoc SnapshotsLoc
-	Remotes      []RemoteSnapshotsLoc
+	Directory     string
+	SnapshotsLoc  SnapshotsLoc
+	Remotes       []RemoteSnapshotsLoc
+	Pinned        bool
+	ArchiveConfig ArchiveConfig
+}
+
+// dropArchiveParent removes the record of the parent of the next incremental
+// archive once incremental archiving is disabled. Nothing would replace it
+// any more, so CleanUp would keep that snapshot forever
+func (subvolume Subvolume) dropArchiveParent() (err error) {
+	if subvolume.ArchiveConfig.Enabled && subvolume.ArchiveConfig.Incremental {
+		return
+	}
+	return subvolume.SnapshotsLoc.SetArchiveParent("")
 }
 
 func (subvolume Subvolume) Print() {
@@ -24,10 +59,7 @@ func (subvolume Subvolume) Print() {
 	for _, remote := range subvolume.Remotes {
 		dst := remote.SnapshotsLoc.Directory
 		if remote.Host != "" {
-			dst = strings.Join([]string{remote.Host, dst}, ":")
-			if remote.User != "" {
-				dst = strings.Join([]string{remote.User, dst}, "@")
-			}
+			dst = strings.Join([]string{remote.sshPath(), dst}, ":")
 		}
 		if verbosity > 0 {
 			log.Printf("Remote Dir='%s' (%s)\n", dst, remote.SnapshotsLoc.Limits.String())
@@ -73,57 +105,30 @@ func (subvolume Subvolume) RunSnapshot() (err error) {
 		}
 		return
 	}
-	if *pinnedFlag {
+	if subvolume.Pinned {
 		subvolume.SnapshotsLoc.PinTimestamp(timestamp)
 	}
-	if *archiveFlag {
-		archiveDir := path.Join(subvolume.SnapshotsLoc.Directory, "archive")
-		err = os.MkdirAll(archiveDir, dirMode)
-		if err != nil {
-			return
-		}
-
-		btrfsCmd = exec.Command(btrfsBin, "send", snapshot.Path())
-
-		extension := ""
-		if !*noCompressionFlag {
-			extension = ".snpy"
-		}
-		archiveFile := path.Join(archiveDir, string(timestamp)+".snap"+extension)
-		f, err := os.Create(archiveFile)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-
-		if *noCompressionFlag {
-			bf := bufio.NewWriter(f)
-			defer bf.Flush()
-			btrfsCmd.Stdout = bf
-		} else {
-			bf := snappy.NewBufferedWriter(f)
-			defer bf.Close()
-			btrfsCmd.Stdout = bf
-		}
-
-		if verbosity > 1 {
-			printCommand(btrfsCmd)
-			btrfsCmd.Stderr = os.Stderr
-		}
-		err = btrfsCmd.Run()
-		if err != nil {
-			// Not sure what to do if error
-			_ = f.Close()
-			os.Remove(archiveFile)
-			return err
-		}
-	}
-
 	timestamps, err := subvolume.SnapshotsLoc.ReadTimestampsDir()
 	if err != nil {
 		return
 	}
+	// A failed archive, such as one to an unplugged disk, mustn't stop the
+	// remotes and the clean up. Its error is returned once they are done
+	var archiveErr error
+	if subvolume.ArchiveConfig.Enabled {
+		archiveErr = subvolume.Archive(snapshot, timestamps)
+		if archiveErr != nil && verbosity > 0 {
+			log.Println("Error archiving snapshot")
+		}
+	}
+	now := time.Now()
 	for _, remote := range subvolume.Remotes {
+		if !remote.InWindow(now) {
+			if verbosity > 0 {
+				log.Printf("Skipping remote '%s'. Outside of send windows\n", remote.SnapshotsLoc.Directory)
+			}
+			continue
+		}
 		err = remote.sendSnapshotUsingParent(snapshot, timestamps)
 		if err != nil {
 			log.Println("Error sending snapshot")
@@ -132,9 +137,14 @@ func (subvolume Subvolume) RunSnapshot() (err error) {
 			continue
 		}
 	}
+	err = subvolume.dropArchiveParent()
+	if err != nil {
+		return
+	}
 	_, err = subvolume.SnapshotsLoc.CleanUp(timestamp, timestamps)
 	if err != nil {
 		return
 	}
+	err = archiveErr
 	return
 }
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDropArchiveParent(t *testing.T) {
+	tests := []struct {
+		config ArchiveConfig
+		kept   bool
+	}{
+		{ArchiveConfig{Enabled: true, Incremental: true}, true},
+		{ArchiveConfig{Enabled: true}, false},
+		{ArchiveConfig{Incremental: true}, false},
+		{ArchiveConfig{}, false},
+	}
+	for _, test := range tests {
+		subvolume := Subvolume{SnapshotsLoc: SnapshotsLoc{Directory: t.TempDir()}, ArchiveConfig: test.config}
+		err := subvolume.SnapshotsLoc.SetArchiveParent("20160101_000000")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = subvolume.dropArchiveParent()
+		if err != nil {
+			t.Errorf("%+v: %s", test.config, err)
+		}
+		parent, err := subvolume.SnapshotsLoc.ArchiveParent()
+		if err != nil {
+			t.Errorf("%+v: %s", test.config, err)
+		}
+		if (parent != "") != test.kept {
+			t.Errorf("%+v: archive parent %q, want kept %v", test.config, parent, test.kept)
+		}
+	}
+	// Without a record there is nothing to remove
+	err := Subvolume{SnapshotsLoc: SnapshotsLoc{Directory: t.TempDir()}}.dropArchiveParent()
+	if err != nil {
+		t.Errorf("Without an archive parent: %s", err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// btrfsRootInode is the inode number of the root directory of every btrfs
+// subvolume
+const btrfsRootInode uint64 = 256
+
+// SubvolumeInfo holds the properties of a snapshot that are compared
+// between locations
+type SubvolumeInfo struct {
+	Timestamp    string
+	UUID         string
+	ReceivedUUID string
+	ReadOnly     bool
+}
+
+// SourceUUID returns the UUID that a copy of this snapshot made with btrfs
+// send/receive has as its received UUID
+func (info SubvolumeInfo) SourceUUID() string {
+	if info.ReceivedUUID != "" {
+		return info.ReceivedUUID
+	}
+	return info.UUID
+}
+
+// parseSubvolumeShow reads the output of btrfs subvolume show
+func parseSubvolumeShow(out []byte) (info SubvolumeInfo) {
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+		if value == "-" {
+			value = ""
+		}
+		switch key {
+		case "UUID":
+			info.UUID = value
+		case "Received UUID":
+			info.ReceivedUUID = value
+		case "Flags":
+			info.ReadOnly = strings.Contains(value, "readonly")
+		}
+	}
+	return
+}
+
+func getSubvolumeInfo(subvolumePath string) (info SubvolumeInfo, err error) {
+	cmd := exec.Command(btrfsBin, "subvolume", "show", subvolumePath)
+	out, err := cmd.Output()
+	if err != nil {
+		return
+	}
+	info = parseSubvolumeShow(out)
+	return
+}
+
+// ReadSubvolumeInfos returns the properties of every snapshot in the
+// timestamp directory
+func (snapshotsLoc SnapshotsLoc) ReadSubvolumeInfos() (infos []SubvolumeInfo, err error) {
+	timestamps, err := snapshotsLoc.ReadTimestampsDir()
+	if err != nil {
+		return
+	}
+	for _, timestamp := range timestamps {
+		var info SubvolumeInfo
+		info, err = getSubvolumeInfo(Snapshot{snapshotsLoc, timestamp}.Path())
+		if err != nil {
+			return
+		}
+		info.Timestamp = string(timestamp)
+		infos = append(infos, info)
+	}
+	return
+}
+
+// isSubvolume reports whether dir is the root of a btrfs subvolume
+func isSubvolume(dir string) bool {
+	var stat syscall.Stat_t
+	if err := syscall.Lstat(dir, &stat); err != nil {
+		return false
+	}
+	return stat.Ino == btrfsRootInode
+}
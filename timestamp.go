@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"sort"
 	"time"
 )
@@ -38,3 +39,44 @@ func calcParent(localTimestamps []Timestamp, remoteTimestamps []Timestamp) Times
 	}
 	return ""
 }
+
+// parseTargetTime parses a point in time given on the command line. A date
+// without a time of day refers to the end of that day
+func parseTargetTime(target string) (t time.Time, err error) {
+	for _, format := range []string{timeFormat, "2006-01-02 15:04:05", "2006-01-02 15:04", time.RFC3339} {
+		t, err = time.ParseInLocation(format, target, time.Local)
+		if err == nil {
+			return
+		}
+	}
+	t, err = time.ParseInLocation("2006-01-02", target, time.Local)
+	if err == nil {
+		t = t.AddDate(0, 0, 1).Add(-time.Second)
+		return
+	}
+	err = fmt.Errorf("Unrecognized time '%s'", target)
+	return
+}
+
+// timestampAtOrBefore returns the newest of timestamps at or before target.
+// An empty target selects the newest timestamp. timestamp is empty if none
+// match
+func timestampAtOrBefore(timestamps []Timestamp, target string) (timestamp Timestamp, err error) {
+	var targetTime time.Time
+	if target != "" {
+		targetTime, err = parseTargetTime(target)
+		if err != nil {
+			return
+		}
+	}
+	for _, candidate := range timestamps {
+		t, errParse := parseTimestamp(candidate)
+		if errParse != nil {
+			continue
+		}
+		if (target == "" || !t.After(targetTime)) && candidate > timestamp {
+			timestamp = candidate
+		}
+	}
+	return
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// tlsHandshakeTimeout limits how long a client of the receive daemon may
+// take to complete the TLS handshake
+const tlsHandshakeTimeout time.Duration = 30 * time.Second
+
+// tlsIdleTimeout is how long the receive daemon waits for a client to send or
+// accept more data. A client that stalls could otherwise keep the lock on a
+// destination forever. It is generous, as a client resuming a transfer reads
+// the part of the stream that was already sent before continuing
+const tlsIdleTimeout time.Duration = time.Hour
+
+// deadlineConn refreshes the deadline of the connection before every read
+// and write, so that only connections that make no progress time out
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c deadlineConn) Read(p []byte) (n int, err error) {
+	err = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	if err != nil {
+		return
+	}
+	return c.Conn.Read(p)
+}
+
+func (c deadlineConn) Write(p []byte) (n int, err error) {
+	err = c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	if err != nil {
+		return
+	}
+	return c.Conn.Write(p)
+}
+
+func loadCertPool(file string) (pool *x509.CertPool, err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		err = fmt.Errorf("No certificates found in '%s'", file)
+	}
+	return
+}
+
+func newTLSConfig(certFile string, keyFile string, caFile string) (config *tls.Config, err error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return
+	}
+	pool, err := loadCertPool(caFile)
+	if err != nil {
+		return
+	}
+	config = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12}
+	// The pool is used to verify the server on the client side and the
+	// clients on the server side
+	config.RootCAs = pool
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return
+}
+
+// peerNames returns the names from the verified client certificate that
+// are matched against the clients allowed for a destination
+func peerNames(conn *tls.Conn) (names []string) {
+	state := conn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return
+	}
+	cert := state.PeerCertificates[0]
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	return
+}
+
+func serveTLSConn(config ServerConfig, conn *tls.Conn) {
+	defer conn.Close()
+	addr := conn.RemoteAddr().String()
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	err := conn.Handshake()
+	if err != nil {
+		log.Printf("%s: %s\n", addr, err.Error())
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	names := peerNames(conn)
+	if verbosity > 0 {
+		log.Printf("%s: Connection from %v\n", addr, names)
+	}
+	timed := deadlineConn{conn, tlsIdleTimeout}
+	rpc := newRPCConn(timed, timed, nil)
+	err = serveRPC(rpc, func(request *Request) (err error) {
+		var destination ServerDestination
+		request.Destination, destination, err = config.Authorize(names, request.Destination)
+		if err != nil {
+			return
+		}
+		destination.ApplyRestrictedPolicy(request, time.Now())
+		return
+	})
+	if err != nil {
+		log.Printf("%s: %s\n", addr, err.Error())
+	}
+	// Unlike over ssh the client doesn't have to wait for forwarding to
+	// finish. The daemon logs it to its own stderr
+	conn.Close()
+	config.ForwardReceived(rpc.received)
+}
+
+func runServe() {
+	if flag.NArg() != 2 {
+		log.Println("Server config file required")
+		os.Exit(1)
+	}
+	config, err := parseServerFile(flag.Arg(1))
+	if err != nil {
+		log.Println("Error parsing server config")
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	tlsConfig, err := newTLSConfig(config.Cert, config.Key, config.ClientCA)
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	listener, err := tls.Listen("tcp", config.Listen, tlsConfig)
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	if verbosity > 0 {
+		log.Printf("Listening on %s\n", config.Listen)
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		go serveTLSConn(config, conn.(*tls.Conn))
+	}
+}
+
+func (remote RemoteSnapshotsLoc) dialTLS() (conn *tls.Conn, err error) {
+	tlsConfig, err := newTLSConfig(remote.Cert, remote.Key, remote.CA)
+	if err != nil {
+		return
+	}
+	addr := net.JoinHostPort(remote.Host, remote.Port)
+	if verbosity > 1 {
+		log.Printf("Connecting to %s\n", addr)
+	}
+	conn, err = tls.Dial("tcp", addr, tlsConfig)
+	return
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestStalledClientTimesOut(t *testing.T) {
+	dir := t.TempDir()
+	dest := path.Join(dir, "backups")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		timed := deadlineConn{server, 100 * time.Millisecond}
+		done <- serveRPC(newRPCConn(timed, timed, nil), func(request *Request) error { return nil })
+		server.Close()
+	}()
+
+	// The client starts a resumable receive and stalls part way through
+	// the stream
+	conn := newRPCConn(client, client, nil)
+	err = conn.handshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.writeJSON(frameRequest, Request{
+		Op:          OpReceive,
+		Destination: dest,
+		Timestamp:   "20160101_000000",
+		Resume:      true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.DataWriter().Write([]byte("btrfs-stream"))
+	if err == nil {
+		err = conn.wr.Flush()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err = <-done:
+		if err == nil {
+			t.Errorf("Server returned without an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Server is still waiting for the stalled client")
+	}
+	lock, err := NewDirLock(dest)
+	if err != nil {
+		t.Fatalf("Destination is still locked: %s", err)
+	}
+	lock.Unlock()
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var sampleFlag = flag.Int("sample", 0, "Number of files to compare by content in verify")
+
+func hashFile(file string) (digest string, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return
+	}
+	digest = hex.EncodeToString(h.Sum(nil))
+	return
+}
+
+// HashFiles returns the SHA-256 of each of the given paths, which are
+// relative to the snapshot. Paths that don't resolve to a regular file
+// inside the snapshot get an empty hash
+func (s Snapshot) HashFiles(paths []string) (hashes []string, err error) {
+	root, err := filepath.EvalSymlinks(s.Path())
+	if err != nil {
+		return
+	}
+	for _, relPath := range paths {
+		digest := ""
+		full, err := filepath.EvalSymlinks(path.Join(root, path.Clean("/"+relPath)))
+		if err == nil && isSubdir(root, full) {
+			fi, err := os.Stat(full)
+			if err == nil && fi.Mode().IsRegular() {
+				digest, _ = hashFile(full)
+			}
+		}
+		hashes = append(hashes, digest)
+	}
+	return
+}
+
+// sampleFiles picks up to n regular files at random from the tree at root
+// and returns their paths relative to it
+func sampleFiles(root string, n int) (files []string, err error) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	seen := 0
+	err = filepath.Walk(root, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		relPath := strings.TrimPrefix(strings.TrimPrefix(file, root), "/")
+		seen++
+		if len(files) < n {
+			files = append(files, relPath)
+		} else if i := rng.Intn(seen); i < n {
+			files[i] = relPath
+		}
+		return nil
+	})
+	return
+}
+
+func (remote RemoteSnapshotsLoc) String() string {
+	if remote.Host == "" {
+		return remote.SnapshotsLoc.Directory
+	}
+	return remote.sshPath() + ":" + remote.SnapshotsLoc.Directory
+}
+
+// subvolumeInfos returns the properties of the snapshots on the remote
+func (remote RemoteSnapshotsLoc) subvolumeInfos() (infos []SubvolumeInfo, err error) {
+	if remote.Host == "" {
+		return remote.SnapshotsLoc.ReadSubvolumeInfos()
+	}
+	conn, err := remote.dialRPC()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	return conn.subvolumeInfos(remote.SnapshotsLoc.Directory)
+}
+
+// subvolumeInfos returns the properties of the snapshots in the directory
+// on the other end of the connection
+func (conn *rpcConn) subvolumeInfos(dir string) (infos []SubvolumeInfo, err error) {
+	if !conn.Has(CapUUID) {
+		err = fmt.Errorf("Remote doesn't support reporting UUIDs")
+		return
+	}
+	response, err := conn.Call(Request{
+		Op:          OpInfo,
+		Destination: dir}, nil)
+	infos = response.Subvolumes
+	return
+}
+
+// hashFiles hashes files in the snapshot with the given timestamp on the
+// remote
+func (remote RemoteSnapshotsLoc) hashFiles(timestamp Timestamp, paths []string) (hashes []string, err error) {
+	if remote.Host == "" {
+		return Snapshot{remote.SnapshotsLoc, timestamp}.HashFiles(paths)
+	}
+	conn, err := remote.dialRPC()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if !conn.Has(CapHashFiles) {
+		err = fmt.Errorf("Remote doesn't support hashing files")
+		return
+	}
+	response, err := conn.Call(Request{
+		Op:          OpHashFiles,
+		Destination: remote.SnapshotsLoc.Directory,
+		Timestamp:   string(timestamp),
+		Paths:       paths}, nil)
+	hashes = response.Hashes
+	return
+}
+
+// verifyRemote compares the snapshots on a remote with the local ones and
+// returns a description of every discrepancy found
+func verifyRemote(subvolume Subvolume, remote RemoteSnapshotsLoc, localInfos []SubvolumeInfo) (problems []string, err error) {
+	remoteInfos, err := remote.subvolumeInfos()
+	if err != nil {
+		return
+	}
+	remoteMap := make(map[string]SubvolumeInfo)
+	for _, info := range remoteInfos {
+		remoteMap[info.Timestamp] = info
+		if !info.ReadOnly {
+			problems = append(problems, fmt.Sprintf("%s is not read-only on the remote", info.Timestamp))
+		}
+	}
+	var common []SubvolumeInfo
+	for _, local := range localInfos {
+		info, ok := remoteMap[local.Timestamp]
+		if !ok {
+			if verbosity > 1 {
+				log.Printf("%s is not on the remote\n", local.Timestamp)
+			}
+			continue
+		}
+		common = append(common, local)
+		if info.ReceivedUUID != local.SourceUUID() {
+			problems = append(problems, fmt.Sprintf("%s has received UUID '%s' on the remote, expected '%s'", local.Timestamp, info.ReceivedUUID, local.SourceUUID()))
+		}
+	}
+	// Snapshots taken after the end of the last send window are pending
+	// rather than missing
+	lastAllowed := remote.LastAllowed(time.Now())
+	pending := 0
+	for i := len(localInfos) - 1; i >= 0; i-- {
+		latest := localInfos[i].Timestamp
+		t, errTmp := parseTimestamp(Timestamp(latest))
+		if errTmp == nil && t.After(lastAllowed) {
+			if _, ok := remoteMap[latest]; !ok {
+				pending++
+			}
+			continue
+		}
+		if _, ok := remoteMap[latest]; !ok {
+			problems = append(problems, fmt.Sprintf("Latest snapshot %s is not on the remote", latest))
+		}
+		break
+	}
+	if pending > 0 && verbosity > 0 {
+		log.Printf("Remote '%s': %d snapshots pending until the next send window\n", remote.String(), pending)
+	}
+	if verbosity > 0 {
+		log.Printf("Remote '%s': %d local, %d remote, %d in common\n", remote.String(), len(localInfos), len(remoteInfos), len(common))
+	}
+	if *sampleFlag > 0 && len(common) > 0 {
+		timestamp := Timestamp(common[len(common)-1].Timestamp)
+		localSnapshot := Snapshot{subvolume.SnapshotsLoc, timestamp}
+		var files, localHashes, remoteHashes []string
+		files, err = sampleFiles(localSnapshot.Path(), *sampleFlag)
+		if err != nil {
+			return
+		}
+		localHashes, err = localSnapshot.HashFiles(files)
+		if err != nil {
+			return
+		}
+		remoteHashes, err = remote.hashFiles(timestamp, files)
+		if err != nil {
+			return
+		}
+		if len(remoteHashes) != len(files) {
+			err = fmt.Errorf("Remote returned %d hashes for %d files", len(remoteHashes), len(files))
+			return
+		}
+		for i, file := range files {
+			if localHashes[i] != remoteHashes[i] {
+				problems = append(problems, fmt.Sprintf("%s: '%s' differs", string(timestamp), file))
+			}
+		}
+		if verbosity > 0 {
+			log.Printf("Compared %d files in %s\n", len(files), string(timestamp))
+		}
+	}
+	return
+}
+
+func runVerify() {
+	if flag.NArg() != 2 {
+		log.Println("Config file required")
+		os.Exit(1)
+	}
+	config, err := parseFile(flag.Arg(1))
+	if err != nil {
+		log.Println("Erroring parsing file")
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	isErr := false
+	for _, subvolume := range parseConfig(config) {
+		if verbosity > 0 {
+			log.Printf("Subvolume='%s'\n", subvolume.Directory)
+		}
+		localInfos, err := subvolume.SnapshotsLoc.ReadSubvolumeInfos()
+		if err != nil {
+			log.Println(err.Error())
+			isErr = true
+			continue
+		}
+		for _, info := range localInfos {
+			if !info.ReadOnly {
+				log.Printf("%s is not read-only\n", info.Timestamp)
+				isErr = true
+			}
+		}
+		for _, remote := range subvolume.Remotes {
+			problems, err := verifyRemote(subvolume, remote, localInfos)
+			if err != nil {
+				log.Printf("Remote '%s': %s\n", remote.String(), err.Error())
+				isErr = true
+				continue
+			}
+			for _, problem := range problems {
+				log.Printf("Remote '%s': %s\n", remote.String(), problem)
+			}
+			if len(problems) > 0 {
+				isErr = true
+			} else if verbosity > 0 {
+				log.Printf("Remote '%s': OK\n", remote.String())
+			}
+		}
+	}
+	if isErr {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TimeWindow is a daily period of time given in minutes since midnight. A
+// window with End before Start wraps around midnight
+type TimeWindow struct {
+	Start int
+	End   int
+}
+
+func parseClock(s string) (minutes int, err error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		err = fmt.Errorf("Invalid time '%s'", s)
+		return
+	}
+	minutes = t.Hour()*60 + t.Minute()
+	return
+}
+
+// parseTimeWindow parses a window in the form "22:00-06:00"
+func parseTimeWindow(s string) (window TimeWindow, err error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		err = fmt.Errorf("Invalid time window '%s'", s)
+		return
+	}
+	window.Start, err = parseClock(parts[0])
+	if err != nil {
+		return
+	}
+	window.End, err = parseClock(parts[1])
+	return
+}
+
+func (window TimeWindow) Contains(t time.Time) bool {
+	minutes := t.Hour()*60 + t.Minute()
+	if window.Start <= window.End {
+		return minutes >= window.Start && minutes < window.End
+	}
+	return minutes >= window.Start || minutes < window.End
+}
+
+func (window TimeWindow) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", window.Start/60, window.Start%60, window.End/60, window.End%60)
+}